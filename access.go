@@ -0,0 +1,38 @@
+package s4lru
+
+import "time"
+
+// accessRing holds the last cap(t) access times of an item
+type accessRing struct {
+	t    []time.Time
+	next int // slot to overwrite once t is full
+}
+
+func (r *accessRing) add(now time.Time) {
+	if len(r.t) < cap(r.t) {
+		r.t = append(r.t, now)
+		return
+	}
+	r.t[r.next] = now
+	r.next = (r.next + 1) % len(r.t)
+}
+
+// AccessTimes returns the times of the last reads of key, oldest first, and
+// whether key is present.  Times are only recorded for caches created
+// WithAccessTimes; otherwise, and for an item not read since it was
+// inserted, the slice is empty.  It does not count as a read itself.
+func (c *Cache) AccessTimes(key string) ([]time.Time, bool) {
+	i, ok := c.get(key)
+	if !ok {
+		return nil, false
+	}
+	x := c.items[i].extra
+	if x == nil || x.times == nil {
+		return nil, true
+	}
+	r := x.times
+	times := make([]time.Time, 0, len(r.t))
+	times = append(times, r.t[r.next:]...)
+	times = append(times, r.t[:r.next]...)
+	return times, true
+}
@@ -0,0 +1,45 @@
+package s4lru
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAccessTimes(t *testing.T) {
+
+	clock := &fakeClock{t: time.Unix(0, 0)}
+
+	c := New(8, WithAccessTimes(3))
+	c.Now = clock.Now
+
+	c.Set("a", 1)
+
+	if times, ok := c.AccessTimes("a"); !ok || len(times) != 0 {
+		t.Errorf("AccessTimes before any read=(%v,%v), want ([],true)", times, ok)
+	}
+
+	var reads []time.Time
+	for i := 0; i < 5; i++ {
+		clock.Advance(time.Second)
+		reads = append(reads, clock.Now())
+		c.Get("a")
+	}
+
+	// only the last three reads are kept, oldest first
+	if times, ok := c.AccessTimes("a"); !ok || !reflect.DeepEqual(times, reads[2:]) {
+		t.Errorf("AccessTimes(a)=(%v,%v), want (%v,true)", times, ok, reads[2:])
+	}
+
+	if _, ok := c.AccessTimes("missing"); ok {
+		t.Errorf("AccessTimes reported a missing key as present")
+	}
+
+	// without the option nothing is recorded
+	c = New(8)
+	c.Set("a", 1)
+	c.Get("a")
+	if times, _ := c.AccessTimes("a"); len(times) != 0 {
+		t.Errorf("recorded access times without WithAccessTimes: %v", times)
+	}
+}
@@ -0,0 +1,58 @@
+package s4lru
+
+// adaptive tracks per-segment hits for WithAdaptive
+type adaptive struct {
+	interval int      // hits between rebalances
+	hits     int      // hits since the last rebalance
+	segHits  []uint64 // decayed hit counts per segment
+}
+
+func (a *adaptive) hit(seg int) {
+	for len(a.segHits) <= seg {
+		a.segHits = append(a.segHits, 0)
+	}
+	a.segHits[seg]++
+	a.hits++
+}
+
+func (a *adaptive) due() bool {
+	return a.hits >= a.interval
+}
+
+// rebalance moves one slot of capacity from the idlest segment to the
+// busiest, as described by WithAdaptive
+func (c *Cache) rebalance() {
+	a := c.adapt
+	a.hits = 0
+
+	for len(a.segHits) < len(c.lists) {
+		a.segHits = append(a.segHits, 0)
+	}
+
+	busy, idle := -1, -1
+	for seg := range c.lists {
+		if busy < 0 || a.segHits[seg] > a.segHits[busy] {
+			busy = seg
+		}
+		floor := 1
+		if seg == 0 && c.minAdmission > floor {
+			floor = c.minAdmission
+		}
+		if c.caps[seg] > floor && (idle < 0 || a.segHits[seg] < a.segHits[idle]) {
+			idle = seg
+		}
+	}
+
+	if idle >= 0 && busy != idle && a.segHits[busy] >= 2*a.segHits[idle] && a.segHits[busy] > 0 {
+		if c.Logger != nil {
+			c.Logger("rebalance segment=%d cap=%d->%d segment=%d cap=%d->%d", idle, c.caps[idle], c.caps[idle]-1, busy, c.caps[busy], c.caps[busy]+1)
+		}
+		c.caps[idle]--
+		c.caps[busy]++
+		c.cascade(idle)
+	}
+
+	for seg := range a.segHits {
+		a.segHits[seg] /= 2
+	}
+}
@@ -0,0 +1,126 @@
+package s4lru
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// CacheAside is a concurrency-safe cache that loads missing values itself.
+// Get returns a cached value if there is one; otherwise it calls Load,
+// stores the result with a TTL and returns it.
+//
+// Concurrent misses for the same key share a single call to Load, so a
+// popular key expiring doesn't send a stampede of requests to the backend.
+// Each stored value's TTL is randomized within ±Jitter of the configured TTL,
+// so that values loaded together don't all expire together either.
+type CacheAside struct {
+	cache  *SyncCache
+	load   func(ctx context.Context, key string) (interface{}, error)
+	ttl    time.Duration
+	jitter float64
+
+	mu    sync.Mutex // protects calls and rand
+	calls map[string]*asideCall
+	rand  *rand.Rand
+}
+
+// asideCall is a Load in progress, shared by every Get waiting for its key
+type asideCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// NewCacheAside returns a new CacheAside holding up to capacity items, each
+// stored for ttl, give or take jitter, a fraction of ttl between 0 and 1:
+// with jitter 0.1, TTLs range from 0.9*ttl to 1.1*ttl.  NewCacheAside will
+// panic if ttl is not positive, jitter is out of range, or load is nil; it
+// has the same restrictions on capacity as New.
+func NewCacheAside(capacity int, ttl time.Duration, jitter float64, load func(ctx context.Context, key string) (interface{}, error)) *CacheAside {
+	if ttl <= 0 {
+		panic("s4lru: TTL must be positive")
+	}
+	if jitter < 0 || jitter >= 1 {
+		panic("s4lru: jitter must be at least 0 and less than 1")
+	}
+	if load == nil {
+		panic("s4lru: nil load function")
+	}
+	return &CacheAside{
+		cache:  NewSync(capacity),
+		load:   load,
+		ttl:    ttl,
+		jitter: jitter,
+		calls:  make(map[string]*asideCall),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Get returns the value for key, loading and storing it if it isn't cached.
+// A load error is returned to every caller waiting on that load and nothing
+// is stored, so the next Get tries again; a load that panics is reported as
+// an error in the same way.  If ctx is done before the value is available,
+// Get returns ctx.Err().  The load runs in its own goroutine with the context
+// of the Get that started it, so it carries on for the other callers if any
+// of them, including the one that started it, gives up; a Load that honours
+// its context will stop once that first context is done.
+func (a *CacheAside) Get(ctx context.Context, key string) (interface{}, error) {
+	if v, ok := a.cache.Get(key); ok {
+		return v, nil
+	}
+
+	a.mu.Lock()
+	call, loading := a.calls[key]
+	if !loading {
+		// a load could have stored the key and finished since the miss
+		if v, ok := a.cache.Peek(key); ok {
+			a.mu.Unlock()
+			return v, nil
+		}
+		call = &asideCall{done: make(chan struct{})}
+		a.calls[key] = call
+		go a.run(ctx, key, call)
+	}
+	a.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// run performs the load for call and stores its result
+func (a *CacheAside) run(ctx context.Context, key string, call *asideCall) {
+	defer func() {
+		if r := recover(); r != nil {
+			call.value, call.err = nil, fmt.Errorf("s4lru: loading %q panicked: %v", key, r)
+		}
+		a.mu.Lock()
+		delete(a.calls, key)
+		a.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.value, call.err = a.load(ctx, key)
+	if call.err == nil {
+		a.cache.SetWithTTL(key, call.value, a.jitteredTTL())
+	}
+}
+
+// Stats returns a snapshot of the underlying cache's counters
+func (a *CacheAside) Stats() Stats {
+	return a.cache.Stats()
+}
+
+// jitteredTTL returns the TTL for a newly loaded value
+func (a *CacheAside) jitteredTTL() time.Duration {
+	a.mu.Lock()
+	f := a.rand.Float64()
+	a.mu.Unlock()
+	return time.Duration(float64(a.ttl) * (1 + a.jitter*(2*f-1)))
+}
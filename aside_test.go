@@ -0,0 +1,161 @@
+package s4lru
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheAsideLoadsOnce(t *testing.T) {
+
+	var loads int32
+	release := make(chan struct{})
+	a := NewCacheAside(64, time.Hour, 0.1, func(ctx context.Context, key string) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return key + "!", nil
+	})
+
+	const goroutines = 16
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := a.Get(context.Background(), "k")
+			if err != nil || v != "k!" {
+				t.Errorf("Get(k)=(%v,%v), want (k!,nil)", v, err)
+			}
+		}()
+	}
+
+	// let every goroutine reach the miss before the load completes
+	for {
+		a.mu.Lock()
+		started := a.calls["k"] != nil
+		a.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Errorf("%d concurrent misses made %d loads, want 1", goroutines, n)
+	}
+
+	// now it's cached
+	if v, err := a.Get(context.Background(), "k"); err != nil || v != "k!" {
+		t.Errorf("Get(k) after loading=(%v,%v)", v, err)
+	}
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Errorf("a cached key was loaded again")
+	}
+
+	// a miss that races with a load finishing doesn't start another
+	a.mu.Lock()
+	got := make(chan interface{})
+	go func() {
+		v, _ := a.Get(context.Background(), "late")
+		got <- v
+	}()
+	time.Sleep(10 * time.Millisecond) // let it miss and wait for the lock
+	a.cache.Set("late", "late!")
+	a.mu.Unlock()
+	if v := <-got; v != "late!" {
+		t.Errorf("Get(late)=%v, want late!", v)
+	}
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Errorf("a key stored after the miss was loaded again")
+	}
+}
+
+func TestCacheAsideErrors(t *testing.T) {
+
+	errLoad := errors.New("backend down")
+	var loads int32
+	a := NewCacheAside(64, time.Hour, 0, func(ctx context.Context, key string) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		return nil, errLoad
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := a.Get(context.Background(), "k"); err != errLoad {
+			t.Errorf("Get(k): err=%v, want %v", err, errLoad)
+		}
+	}
+	if n := atomic.LoadInt32(&loads); n != 2 {
+		t.Errorf("failed loads were cached: %d loads for 2 misses", n)
+	}
+
+	block := make(chan struct{})
+	defer close(block)
+	a = NewCacheAside(64, time.Hour, 0, func(ctx context.Context, key string) (interface{}, error) {
+		<-block
+		return nil, nil
+	})
+	// the caller that starts a load that ignores its context can still
+	// give up
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := a.Get(ctx, "k"); err != context.DeadlineExceeded {
+		t.Errorf("Get with an expiring context: err=%v, want DeadlineExceeded", err)
+	}
+
+	// a panicking load fails its callers without wedging the key
+	var panics int32
+	a = NewCacheAside(64, time.Hour, 0, func(ctx context.Context, key string) (interface{}, error) {
+		if atomic.AddInt32(&panics, 1) == 1 {
+			panic("boom")
+		}
+		return "ok", nil
+	})
+	if _, err := a.Get(context.Background(), "k"); err == nil {
+		t.Errorf("Get with a panicking load succeeded")
+	}
+	if v, err := a.Get(context.Background(), "k"); err != nil || v != "ok" {
+		t.Errorf("Get after a panicking load=(%v,%v), want (ok,nil)", v, err)
+	}
+}
+
+func TestCacheAsideJitter(t *testing.T) {
+
+	const ttl = time.Minute
+
+	a := NewCacheAside(64, ttl, 0.2, func(ctx context.Context, key string) (interface{}, error) {
+		return key, nil
+	})
+
+	lo, hi := ttl, ttl
+	for i := 0; i < 1000; i++ {
+		d := a.jitteredTTL()
+		if d < ttl*8/10 || d > ttl*12/10 {
+			t.Fatalf("jittered TTL %v outside ±20%% of %v", d, ttl)
+		}
+		if d < lo {
+			lo = d
+		}
+		if d > hi {
+			hi = d
+		}
+	}
+	if lo > ttl*9/10 || hi < ttl*11/10 {
+		t.Errorf("jittered TTLs only ranged over [%v, %v]", lo, hi)
+	}
+
+	// a loaded value is stored with a TTL in range
+	before := time.Now()
+	a.Get(context.Background(), "k")
+	a.cache.mu.Lock()
+	expires := a.cache.c.items[a.cache.c.data["k"]].extra.expires
+	a.cache.mu.Unlock()
+	if d := expires.Sub(before); d < ttl*8/10 || d > ttl*12/10+time.Second {
+		t.Errorf("stored value expires in %v, want within ±20%% of %v", d, ttl)
+	}
+}
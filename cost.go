@@ -0,0 +1,197 @@
+package s4lru
+
+import (
+	"strconv"
+	"strings"
+)
+
+// NewWithCost returns a new S4LRU cache whose segments are bounded by the
+// total cost of the items they hold rather than by their number.  cost is
+// called with each value as it is stored, and is typically its size in
+// bytes, except for values implementing Sizer, whose Size is used instead;
+// costs below 1 are counted as 1, so that every item takes some room.  Each
+// of the four segments gets 1/4 of capacity, with any remainder going to the
+// lowest segments.  NewWithCost will panic if capacity is negative, cost is
+// nil, or it is given an option that cost mode doesn't support.
+//
+// An item that costs more than segment 0 can hold is never stored: Set drops
+// it, removing any previous value for the key.  Promotion moves an item up
+// only if it fits in the next segment, demoting that segment's coldest items
+// to make room, and eviction frees as many items from the back of segment 0
+// as it takes to fit a new one.  Capacity reports 0 for such a cache;
+// WithAdaptive, WithSoftLimit, WithVictimSelector, WithEvictionBatch,
+// WithMinAdmission, Reshape and Compact are not supported.
+func NewWithCost(capacity int64, cost func(key string, value interface{}) int64, opts ...Option) *Cache {
+	if capacity < 0 {
+		panic("s4lru: negative capacity")
+	}
+	if cost == nil {
+		panic("s4lru: nil cost function")
+	}
+
+	const segments = 4
+	c := &Cache{
+		costFn:   cost,
+		costCaps: make([]int64, segments),
+		caps:     make([]int, segments),
+		data:     make(map[string]int32),
+		items:    make([]cacheItem, 1),
+		lists:    make([]itemList, segments),
+	}
+	for i := range c.costCaps {
+		c.costCaps[i] = capacity / segments
+		if int64(i) < capacity%segments {
+			c.costCaps[i]++
+		}
+	}
+	c.apply(opts)
+	if c.adapt != nil {
+		panic("s4lru: WithAdaptive is not supported in cost mode")
+	}
+	if c.softLimit > 0 {
+		panic("s4lru: WithSoftLimit is not supported in cost mode")
+	}
+	if c.victim != nil {
+		panic("s4lru: WithVictimSelector is not supported in cost mode")
+	}
+	if c.minAdmission > 0 {
+		panic("s4lru: WithMinAdmission is not supported in cost mode")
+	}
+	if c.evictBatch > 1 {
+		panic("s4lru: WithEvictionBatch is not supported in cost mode")
+	}
+	return c
+}
+
+// GetWithCost returns a value from the cache like Get, along with the cost
+// recorded for it when it was stored.  The cost is 0 for a cache that counts
+// items rather than costs.
+func (c *Cache) GetWithCost(key string) (value interface{}, cost int64, ok bool) {
+	i, ok := c.lookup(key)
+	if !ok {
+		return nil, 0, false
+	}
+
+	value, cost = c.items[i].value, c.items[i].cost
+	c.hit(i)
+	return value, cost, true
+}
+
+// Sizer is implemented by values that know their own cost cheaply, such as
+// their encoded size.  A cache created NewWithCost takes the cost of such a
+// value from Size, without calling its cost function, which is then only
+// consulted for other values.  A Set WithCost overrides both.
+type Sizer interface {
+	Size() int64
+}
+
+// costOf returns the cost of storing value under key, or 0 if the cache
+// counts items instead
+func (c *Cache) costOf(key string, value interface{}) int64 {
+	if c.costFn == nil {
+		return 0
+	}
+	if c.setCost > 0 {
+		return c.setCost
+	}
+	var n int64
+	if s, ok := value.(Sizer); ok {
+		n = s.Size()
+	} else {
+		n = c.costFn(key, value)
+	}
+	if n > 0 {
+		return n
+	}
+	return 1
+}
+
+// tooBig reports whether an item of the given cost can't be stored at all
+func (c *Cache) tooBig(cost int64) bool {
+	return c.costFn != nil && cost > c.costCaps[0]
+}
+
+// recost updates the recorded cost of item i after its value changed
+func (c *Cache) recost(i int32) {
+	if c.costFn == nil {
+		return
+	}
+	item := &c.items[i]
+	cost := c.costOf(item.key, item.value)
+	c.lists[item.lidx].cost += cost - item.cost
+	item.cost = cost
+}
+
+// fits reports whether segment seg has room for one more item of the given
+// cost
+func (c *Cache) fits(seg int, cost int64) bool {
+	if c.unbounded {
+		return true
+	}
+	if c.costFn == nil {
+		return c.lists[seg].Len() < c.caps[seg]+c.excess(seg)
+	}
+	return c.lists[seg].cost+cost <= c.costCaps[seg]
+}
+
+// over reports whether segment seg holds more than it should
+func (c *Cache) over(seg int) bool {
+	if c.unbounded {
+		return false
+	}
+	if c.costFn == nil {
+		return c.lists[seg].Len() > c.caps[seg]+c.excess(seg)
+	}
+	return c.lists[seg].cost > c.costCaps[seg]
+}
+
+// String returns the contents of every segment, from segment 0 up, each as
+// its keys from the front to the back followed by its usage, as in
+// "seg0=[c d](2/2) seg1=[a](1/2)".  In cost mode the usage is the total cost
+// against the budget, in bytes, as in "seg0=[c d](1.2KB/4KB)".  It is meant
+// for debugging small caches.
+func (c *Cache) String() string {
+	var sb strings.Builder
+	for seg := range c.lists {
+		if seg > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString("seg")
+		sb.WriteString(strconv.Itoa(seg))
+		sb.WriteString("=[")
+		for i := c.lists[seg].head; i != 0; i = c.items[i].next {
+			if i != c.lists[seg].head {
+				sb.WriteByte(' ')
+			}
+			sb.WriteString(c.items[i].key)
+		}
+		sb.WriteString("](")
+		if c.costFn == nil {
+			sb.WriteString(strconv.Itoa(c.lists[seg].Len()))
+			sb.WriteByte('/')
+			sb.WriteString(strconv.Itoa(c.caps[seg]))
+		} else {
+			sb.WriteString(formatBytes(c.lists[seg].cost))
+			sb.WriteByte('/')
+			sb.WriteString(formatBytes(c.costCaps[seg]))
+		}
+		sb.WriteByte(')')
+	}
+	return sb.String()
+}
+
+// formatBytes formats n with a binary unit and at most one decimal place
+func formatBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return strconv.FormatInt(n, 10) + "B"
+	}
+	f, u := float64(n)/1024, 0
+	for f >= 1024 && u < len(units)-1 {
+		f /= 1024
+		u++
+	}
+	s := strconv.FormatFloat(f, 'f', 1, 64)
+	s = strings.TrimSuffix(s, ".0")
+	return s + units[u:u+1] + "B"
+}
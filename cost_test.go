@@ -0,0 +1,187 @@
+package s4lru
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// lenCost charges each item the length of its string value
+func lenCost(key string, value interface{}) int64 { return int64(len(value.(string))) }
+
+func TestCostMode(t *testing.T) {
+
+	c := NewWithCost(40, lenCost) // 10 per segment
+
+	c.Set("a", "aaaa")
+	c.Set("b", "bbbb")
+	if got := c.SegmentLens(); got[0] != 2 {
+		t.Fatalf("SegmentLens()=%v after two inserts, want 2 in segment 0", got)
+	}
+
+	// 4+4+6 > 10: the oldest item has to go
+	c.Set("c", "cccccc")
+	if _, ok := c.Peek("a"); ok {
+		t.Errorf("a survived an insert that overfilled segment 0")
+	}
+	if _, ok := c.Peek("b"); !ok {
+		t.Errorf("b was evicted although there was room for it")
+	}
+
+	// too costly for any segment
+	c.Set("huge", "xxxxxxxxxxxx")
+	if _, ok := c.Peek("huge"); ok {
+		t.Errorf("stored an item costing more than segment 0's budget")
+	}
+
+	// growing an existing value past the budget drops it
+	c.Set("b", "bbbbbbbbbbbb")
+	if _, ok := c.Peek("b"); ok {
+		t.Errorf("kept an item that grew past segment 0's budget")
+	}
+
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCostModeInvariants(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+	c := NewWithCost(100, lenCost)
+
+	for op := 0; op < 5000; op++ {
+		key := strconv.Itoa(r.Intn(40))
+		switch r.Intn(6) {
+		case 0, 1:
+			c.Set(key, string(make([]byte, r.Intn(15))))
+		case 2, 3, 4:
+			c.Get(key)
+		case 5:
+			c.Remove(key)
+		}
+		if err := c.checkInvariants(); err != nil {
+			t.Fatalf("after op %d: %v", op, err)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+
+	c := New(8)
+	c.Set("a", "x")
+	c.Get("a")
+	c.Set("b", "x")
+	c.Set("c", "x")
+
+	if got, want := c.String(), "seg0=[c b](2/2) seg1=[a](1/2) seg2=[](0/2) seg3=[](0/2)"; got != want {
+		t.Errorf("String()=%q, want %q", got, want)
+	}
+
+	c = NewWithCost(16<<10, lenCost) // 4KB per segment
+	c.Set("a", string(make([]byte, 1229)))
+	c.Get("a")
+	c.Set("b", string(make([]byte, 100)))
+	c.Set("c", string(make([]byte, 2048)))
+
+	if got, want := c.String(), "seg0=[c b](2.1KB/4KB) seg1=[a](1.2KB/4KB) seg2=[](0B/4KB) seg3=[](0B/4KB)"; got != want {
+		t.Errorf("String()=%q, want %q", got, want)
+	}
+}
+
+func TestCostModeUnsupportedOptions(t *testing.T) {
+
+	for name, opt := range map[string]Option{
+		"WithAdaptive":       WithAdaptive(8),
+		"WithSoftLimit":      WithSoftLimit(100),
+		"WithVictimSelector": WithVictimSelector(func(keys []string) string { return keys[0] }),
+		"WithEvictionBatch":  WithEvictionBatch(4),
+		"WithMinAdmission":   WithMinAdmission(4),
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewWithCost with %s didn't panic", name)
+				}
+			}()
+			NewWithCost(40, lenCost, opt)
+		}()
+	}
+}
+
+func TestGetWithCost(t *testing.T) {
+
+	c := NewWithCost(40, lenCost)
+
+	c.Set("a", "aaaa")
+	c.Set("empty", "")
+
+	for _, tt := range []struct {
+		key  string
+		cost int64
+	}{
+		{"a", 4},
+		{"empty", 1}, // costs below 1 are counted as 1
+	} {
+		v, cost, ok := c.GetWithCost(tt.key)
+		if !ok || cost != tt.cost {
+			t.Errorf("GetWithCost(%q)=(%v,%d,%v), want cost %d", tt.key, v, cost, ok, tt.cost)
+		}
+		if seg := c.items[c.slot(tt.key)].lidx; seg != 1 {
+			t.Errorf("GetWithCost(%q) left it in segment %d, want 1", tt.key, seg)
+		}
+	}
+
+	// the cost follows the value
+	c.Set("a", "aaaaaaa")
+	if _, cost, _ := c.GetWithCost("a"); cost != 7 {
+		t.Errorf("cost after update=%d, want 7", cost)
+	}
+
+	if _, _, ok := c.GetWithCost("missing"); ok {
+		t.Errorf("GetWithCost found a missing key")
+	}
+
+	if _, cost, ok := New(8).GetWithCost("x"); ok || cost != 0 {
+		t.Errorf("GetWithCost on an empty cache=(%d,%v)", cost, ok)
+	}
+}
+
+// sized is a value that reports its own cost
+type sized int64
+
+func (s sized) Size() int64 { return int64(s) }
+
+func TestSizer(t *testing.T) {
+
+	calls := 0
+	c := NewWithCost(40, func(key string, value interface{}) int64 {
+		calls++
+		return lenCost(key, value)
+	})
+
+	c.Set("a", sized(7))
+	c.Set("a", sized(3)) // an update recosts through Size too
+	c.Set("z", sized(0))
+	if calls != 0 {
+		t.Errorf("cost function called %d times for Sizer values", calls)
+	}
+	for key, want := range map[string]int64{"a": 3, "z": 1} {
+		if got := c.items[c.slot(key)].cost; got != want {
+			t.Errorf("%s has cost %d, want %d", key, got, want)
+		}
+	}
+
+	c.Set("b", "bbbb")
+	if calls != 1 || c.items[c.slot("b")].cost != 4 {
+		t.Errorf("other values: %d calls, cost %d, want 1 and 4", calls, c.items[c.slot("b")].cost)
+	}
+
+	c.Set("big", sized(11)) // more than segment 0 holds
+	if c.Contains("big") {
+		t.Errorf("stored a Sizer too big for segment 0")
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,258 @@
+package s4lru
+
+import "sort"
+
+// Entry is a copy of a single cached item, as used by the bulk APIs
+type Entry struct {
+	Key     string
+	Value   interface{}
+	Segment int // segment the item occupies, 0 being the admission segment
+}
+
+// Snapshot returns a copy of every item in the cache, from the hottest (the
+// front of the top segment) to the coldest (the back of segment 0).  It does
+// not promote anything.
+func (c *Cache) Snapshot() []Entry {
+	entries := make([]Entry, 0, c.count())
+	for seg := len(c.lists) - 1; seg >= 0; seg-- {
+		for i := c.lists[seg].head; i != 0; i = c.items[i].next {
+			entries = append(entries, Entry{Key: c.items[i].key, Value: c.items[i].value, Segment: seg})
+		}
+	}
+	return entries
+}
+
+// ForEach calls fn for each item in the cache, from the hottest to the
+// coldest as for Snapshot, until fn returns false.  It does not promote
+// anything.  fn may Remove any key, including the one it was called with;
+// an item removed during the walk is skipped and no longer counted by Len,
+// but stays linked as a tombstone, holding on to its key and value, until
+// ForEach returns.  fn may also read the cache with Peek or Contains, but
+// must not otherwise use it.
+func (c *Cache) ForEach(fn func(key string, value interface{}) bool) {
+	c.walking++
+	defer func() {
+		if c.walking--; c.walking == 0 {
+			c.sweep()
+		}
+	}()
+
+	for seg := len(c.lists) - 1; seg >= 0; seg-- {
+		for i := c.lists[seg].head; i != 0; i = c.items[i].next {
+			item := &c.items[i]
+			if len(c.tombstones) > 0 {
+				if j, ok := c.getStored(item.key); !ok || j != i {
+					continue
+				}
+			}
+			if !fn(item.key, item.value) {
+				return
+			}
+		}
+	}
+}
+
+// sweep unlinks the items Remove left in place while ForEach was walking
+func (c *Cache) sweep() {
+	for _, i := range c.tombstones {
+		seg := c.items[i].lidx
+		c.unlink(i)
+		c.release(i)
+		if c.backfillOnRemove {
+			c.backfill(seg)
+		}
+	}
+	c.tombstones = c.tombstones[:0]
+}
+
+// RangeFrom returns up to limit entries for the keys at or after startKey,
+// in ascending key order, for paging through the cache: pass the last key
+// of one page with "\x00" appended as the startKey of the next.  Key order
+// is used because it stays stable as items move between segments.  It does
+// not promote anything, but sorts every key on each call.  A limit of 0 or
+// less returns no entries.
+func (c *Cache) RangeFrom(startKey string, limit int) []Entry {
+	if limit <= 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, c.count())
+	c.each(func(key string, _ int32) bool {
+		if key >= startKey {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	sort.Strings(keys)
+	if limit < len(keys) {
+		keys = keys[:limit]
+	}
+
+	entries := make([]Entry, 0, len(keys))
+	for _, key := range keys {
+		i, _ := c.getStored(key)
+		item := &c.items[i]
+		entries = append(entries, Entry{Key: key, Value: item.value, Segment: item.lidx})
+	}
+	return entries
+}
+
+// EvictionOrder returns every key in the cache in the order the items would
+// be evicted: from the back of segment 0 up to the front of the top segment,
+// the exact reverse of Snapshot.  It does not promote anything.
+func (c *Cache) EvictionOrder() []string {
+	keys := make([]string, 0, c.count())
+	for seg := range c.lists {
+		for i := c.lists[seg].tail; i != 0; i = c.items[i].prev {
+			keys = append(keys, c.items[i].key)
+		}
+	}
+	return keys
+}
+
+// PositionUntilEviction returns the number of items that would be evicted
+// before key, assuming no further reads, which is key's index in
+// EvictionOrder: 0 for the next item to go.  It walks the items behind key
+// in its segment, and does not promote anything.
+func (c *Cache) PositionUntilEviction(key string) (int, bool) {
+	i, ok := c.get(key)
+	if !ok {
+		return 0, false
+	}
+	n := 0
+	for seg := 0; seg < c.items[i].lidx; seg++ {
+		n += c.lists[seg].Len()
+	}
+	for j := c.items[i].next; j != 0; j = c.items[j].next {
+		n++
+	}
+	return n, true
+}
+
+// Restore replaces the contents of the cache with entries, which are taken
+// to be ordered hottest-first as returned by Snapshot.  Each entry is placed
+// at the back of its Segment, clamped to the segments the cache has; entries
+// that don't fit go into the next lower segment with room, and those that
+// fit nowhere are dropped.  Later duplicates of a key are ignored.  Restoring
+// a Snapshot into a cache with the same segment capacities reproduces it
+// exactly, except that TTLs are not preserved.
+func (c *Cache) Restore(entries []Entry) {
+	c.reset()
+	for _, e := range entries {
+		c.restore(e)
+	}
+}
+
+// WarmHot places entries, ordered hottest-first, directly into the upper
+// segments, to protect a known hot set from the cold traffic that follows a
+// restart.  Their Segment fields are ignored: the top segment is filled
+// first, at the back of whatever it already holds, then the one below it,
+// and so on down to segment 0.  Nothing already in the cache is evicted to
+// make room, so new entries that fit nowhere are dropped.  A key already
+// present is moved, taking its new value, unless even its own place can't
+// hold that value, in which case it stays where it was, unchanged.  Later
+// duplicates of a key are ignored.
+func (c *Cache) WarmHot(entries []Entry) {
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		key := c.indexKey(e.Key)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if i, ok := c.get(e.Key); ok {
+			c.warmMove(i, e.Value)
+			continue
+		}
+		c.restore(Entry{Key: e.Key, Value: e.Value, Segment: len(c.lists) - 1})
+	}
+}
+
+// warmMove moves item i, with its new value, to the back of the highest
+// segment with room for it, counting the room it leaves behind
+func (c *Cache) warmMove(i int32, value interface{}) {
+	item := &c.items[i]
+	cost := c.costOf(item.key, value)
+	seg := len(c.lists) - 1
+	for ; seg >= 0; seg-- {
+		if seg != item.lidx {
+			if c.fits(seg, cost) {
+				break
+			}
+		} else if c.unbounded || c.costFn == nil || c.lists[seg].cost-item.cost+cost <= c.costCaps[seg] {
+			break
+		}
+	}
+	if seg < 0 {
+		return
+	}
+	c.unlink(i)
+	item.value = value
+	item.cost = cost
+	c.linkBack(seg, i)
+}
+
+// SetBatch Sets each entry's key and value in turn, ignoring Segment, and
+// returns the entries evicted to make room during the batch, in the order
+// they were evicted, each with the segment it was evicted from.  These can
+// include entries of the batch itself when it holds more keys than fit.
+// OnEvict and the EvictionChan still see every eviction.
+func (c *Cache) SetBatch(entries []Entry) []Entry {
+	var evicted []Entry
+	c.collect = &evicted
+	defer func() { c.collect = nil }()
+	for _, e := range entries {
+		c.Set(e.Key, e.Value)
+	}
+	return evicted
+}
+
+// restore places e at the back of its segment for Restore
+func (c *Cache) restore(e Entry) {
+	key, ok := c.storeKey(e.Key)
+	if !ok {
+		return
+	}
+	e.Key = key
+	if _, ok := c.get(e.Key); ok {
+		return
+	}
+	seg := e.Segment
+	if seg >= len(c.lists) {
+		seg = len(c.lists) - 1
+	}
+	if seg < 0 {
+		seg = 0
+	}
+	cost := c.costOf(e.Key, e.Value)
+	for seg >= 0 && !c.fits(seg, cost) {
+		seg--
+	}
+	if seg < 0 {
+		return
+	}
+	i := c.alloc()
+	c.items[i].key = e.Key
+	c.items[i].value = e.Value
+	c.items[i].cost = cost
+	c.put(e.Key, i)
+	c.inserted(i)
+	c.linkBack(seg, i)
+}
+
+// reset empties the cache without counting anything as evicted
+func (c *Cache) reset() {
+	c.clear()
+	for i := range c.items {
+		if c.items[i].referenced() {
+			c.items[i].extra.refs = 0
+		}
+		c.items[i] = cacheItem{}
+	}
+	c.inUse = 0
+	c.items = c.items[:1]
+	c.free = 0
+	for seg := range c.lists {
+		c.lists[seg] = itemList{}
+	}
+}
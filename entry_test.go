@@ -0,0 +1,332 @@
+package s4lru
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+
+	c := New(8)
+
+	c.Set("a", "a!")
+	c.Get("a")
+	c.Get("a")
+	c.Set("b", "b!")
+	c.Get("b")
+	c.Set("c", "c!")
+
+	want := []Entry{
+		{Key: "a", Value: "a!", Segment: 2},
+		{Key: "b", Value: "b!", Segment: 1},
+		{Key: "c", Value: "c!", Segment: 0},
+	}
+
+	snap := c.Snapshot()
+	if !reflect.DeepEqual(snap, want) {
+		t.Fatalf("Snapshot()=%v, want %v", snap, want)
+	}
+
+	// entries are plain values: changing the copy doesn't touch the cache
+	snap[0].Value = "changed"
+	if v := c.items[c.data["a"]].value; v != "a!" {
+		t.Errorf("modifying a snapshot entry changed the cache")
+	}
+	snap[0].Value = "a!"
+
+	r := New(8)
+	r.Set("stale", 1)
+	r.Restore(snap)
+
+	if got := r.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip through Restore: got %v, want %v", got, want)
+	}
+
+	if _, ok := r.Get("stale"); ok {
+		t.Errorf("Restore kept an item that was not in the entries")
+	}
+
+	// entries that don't fit their segment spill into lower ones
+	var many []Entry
+	for i := 0; i < 6; i++ {
+		many = append(many, Entry{Key: fmt.Sprint(i), Value: i, Segment: 3})
+	}
+	r.Restore(many)
+
+	if got := fmt.Sprint(r.SegmentLens()); got != "[0 2 2 2]" {
+		t.Errorf("segment lengths after spilling Restore: %v, want [0 2 2 2]", got)
+	}
+	if err := r.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	// out of range segments are clamped at both ends
+	r.Restore([]Entry{{Key: "low", Value: 1, Segment: -1}, {Key: "high", Value: 2, Segment: 9}})
+	if got := fmt.Sprint(r.SegmentLens()); got != "[1 0 0 1]" {
+		t.Errorf("segment lengths after clamped Restore: %v, want [1 0 0 1]", got)
+	}
+}
+
+func TestEvictionOrder(t *testing.T) {
+
+	c := New(8)
+
+	c.Set("a", 1)
+	c.Get("a")
+	c.Get("a")
+	c.Set("b", 2)
+	c.Get("b")
+	c.Set("c", 3)
+	c.Set("d", 4)
+	c.Get("d")
+	c.Set("e", 5)
+
+	// segment 0: e c, segment 1: d b, segment 2: a
+	want := []string{"c", "e", "b", "d", "a"}
+	if got := c.EvictionOrder(); !reflect.DeepEqual(got, want) {
+		t.Errorf("EvictionOrder()=%v, want %v", got, want)
+	}
+
+	// the recorded order is the order Set actually evicts in, as far as
+	// segment 0 goes
+	var evicted []string
+	c.OnEvict = func(key string, value interface{}) { evicted = append(evicted, key) }
+	c.Set("x", 0)
+	c.Set("y", 0)
+	if !reflect.DeepEqual(evicted, want[:2]) {
+		t.Errorf("evicted %v, want %v", evicted, want[:2])
+	}
+}
+
+func TestRangeFrom(t *testing.T) {
+
+	c := New(100)
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		c.Set(key, i)
+		if i%3 == 0 {
+			c.Get(key)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var last string
+	pages := 0
+	for start := ""; ; pages++ {
+		page := c.RangeFrom(start, 7)
+		if len(page) == 0 {
+			break
+		}
+		if len(page) > 7 {
+			t.Fatalf("page of %d entries, limit 7", len(page))
+		}
+		for _, e := range page {
+			if seen[e.Key] {
+				t.Errorf("key %q returned twice", e.Key)
+			}
+			if e.Key <= last {
+				t.Errorf("key %q out of order after %q", e.Key, last)
+			}
+			seen[e.Key] = true
+			last = e.Key
+		}
+		start = last + "\x00"
+	}
+
+	if len(seen) != 25 || c.Len() != 25 {
+		t.Errorf("paged through %d keys, cache holds %d, want 25", len(seen), c.Len())
+	}
+	if pages != 4 {
+		t.Errorf("took %d pages, want 4", pages)
+	}
+
+	for _, limit := range []int{0, -1} {
+		if page := c.RangeFrom("", limit); len(page) != 0 {
+			t.Errorf("RangeFrom with limit %d returned %d entries", limit, len(page))
+		}
+	}
+}
+
+func TestForEach(t *testing.T) {
+
+	c := New(16, WithRebalanceOnRemove())
+	for i := 0; i < 8; i++ {
+		key := fmt.Sprint(i)
+		c.Set(key, i)
+		if i%2 == 0 {
+			c.Get(key)
+		}
+	}
+
+	var visited []string
+	c.ForEach(func(key string, value interface{}) bool {
+		visited = append(visited, key)
+		// drop odd values, and 2 before it's reached
+		if value.(int)%2 == 1 {
+			c.Remove(key)
+		}
+		if key == "4" {
+			c.Remove("2")
+		}
+		if c.Contains(key) != (value.(int)%2 == 0) {
+			t.Errorf("Contains(%s) wrong after removing during ForEach", key)
+		}
+		return true
+	})
+
+	if want := []string{"6", "4", "0", "7", "5", "3", "1"}; !reflect.DeepEqual(visited, want) {
+		t.Errorf("visited %v, want %v", visited, want)
+	}
+	if c.Len() != 3 {
+		t.Errorf("Len()=%d, want 3", c.Len())
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	visited = visited[:0]
+	c.ForEach(func(key string, value interface{}) bool {
+		visited = append(visited, key)
+		c.Remove(key)
+		return len(visited) < 2
+	})
+	if len(visited) != 2 || c.Len() != 1 {
+		t.Errorf("stopped walk visited %v and left %d, want 2 and 1", visited, c.Len())
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWarmHot(t *testing.T) {
+
+	c := New(16) // 4 per segment
+	c.Set("old", 0)
+	c.SetWithSegment("top", 0, 3)
+
+	var hot []Entry
+	for i := 0; i < 8; i++ {
+		hot = append(hot, Entry{Key: fmt.Sprint("hot", i), Value: i})
+	}
+	hot = append(hot, Entry{Key: "old", Value: 1})
+	c.WarmHot(hot)
+
+	if got := c.SegmentLens(); !reflect.DeepEqual(got, []int{0, 2, 4, 4}) {
+		t.Fatalf("SegmentLens()=%v after WarmHot, want [0 2 4 4]", got)
+	}
+	if got := c.Snapshot()[:4]; got[0].Key != "top" || got[1].Key != "hot0" || got[3].Key != "hot2" {
+		t.Errorf("top segment %v, want top then hot0..hot2", got)
+	}
+	if seg := c.items[c.slot("old")].lidx; seg != 1 {
+		t.Errorf("existing key moved to segment %d, want 1", seg)
+	}
+	if v, _ := c.Peek("old"); v != 1 {
+		t.Errorf("existing key kept value %v, want 1", v)
+	}
+
+	// a burst of cold keys only churns segment 0
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprint("cold", i), i)
+	}
+	for _, e := range hot {
+		if !c.Contains(e.Key) {
+			t.Errorf("%s didn't survive the cold burst", e.Key)
+		}
+	}
+	// a present key keeps its place rather than losing it to a new one
+	c = New(4) // 1 per segment
+	for seg, key := range []string{"a", "b", "c", "d"} {
+		c.SetWithSegment(key, 0, seg)
+	}
+	c.WarmHot([]Entry{{Key: "x"}, {Key: "d", Value: 2}})
+	if c.Contains("x") {
+		t.Errorf("WarmHot stored x in a full cache")
+	}
+	if v, ok := c.Peek("d"); !ok || v != 2 {
+		t.Errorf("Peek(d)=(%v,%v) after WarmHot, want (2,true)", v, ok)
+	}
+	if seg := c.items[c.slot("d")].lidx; seg != 3 {
+		t.Errorf("d moved to segment %d, want 3", seg)
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPositionUntilEviction(t *testing.T) {
+
+	c := New(16) // 4 per segment
+	c.Set("a", nil)
+	c.Set("b", nil)
+	c.Set("c", nil)
+	c.Get("a")
+	c.SetWithSegment("top", nil, 3)
+
+	// EvictionOrder: b c | a | top
+	for key, want := range map[string]int{"b": 0, "c": 1, "a": 2, "top": 3} {
+		if n, ok := c.PositionUntilEviction(key); !ok || n != want {
+			t.Errorf("PositionUntilEviction(%s)=(%d,%v), want (%d,true)", key, n, ok, want)
+		}
+	}
+	for n, key := range c.EvictionOrder() {
+		if got, _ := c.PositionUntilEviction(key); got != n {
+			t.Errorf("PositionUntilEviction(%s)=%d, but it's at %d in EvictionOrder", key, got, n)
+		}
+	}
+	if _, ok := c.PositionUntilEviction("missing"); ok {
+		t.Errorf("found a position for a missing key")
+	}
+}
+
+func TestSetBatch(t *testing.T) {
+
+	c := New(8) // 2 per segment
+	c.Set("hot", 0)
+	c.Get("hot")
+	c.Set("cold", 0)
+
+	var batch []Entry
+	for i := 0; i < 8; i++ {
+		batch = append(batch, Entry{Key: "k" + strconv.Itoa(i), Value: i})
+	}
+	var onEvict []string
+	c.OnEvict = func(key string, value interface{}) { onEvict = append(onEvict, key) }
+
+	evicted := c.SetBatch(batch)
+
+	want := []Entry{{"cold", 0, 0}}
+	for _, e := range batch[:6] {
+		want = append(want, Entry{e.Key, e.Value, 0})
+	}
+	if !reflect.DeepEqual(evicted, want) {
+		t.Errorf("SetBatch evicted %v, want %v", evicted, want)
+	}
+
+	// the evictions are exactly what didn't survive
+	survivors := map[string]bool{}
+	for _, key := range c.EvictionOrder() {
+		survivors[key] = true
+	}
+	for _, e := range evicted {
+		if survivors[e.Key] {
+			t.Errorf("%s reported evicted but still cached", e.Key)
+		}
+		delete(survivors, e.Key)
+	}
+	if len(survivors) != 3 || !survivors["hot"] || !survivors["k6"] || !survivors["k7"] {
+		t.Errorf("survivors %v, want hot, k6 and k7", survivors)
+	}
+	if len(onEvict) != len(evicted) {
+		t.Errorf("OnEvict saw %d evictions, SetBatch returned %d", len(onEvict), len(evicted))
+	}
+
+	if got := c.SetBatch(nil); got != nil {
+		t.Errorf("empty SetBatch returned %v", got)
+	}
+	c.Set("k8", 8)
+	if c.collect != nil {
+		t.Errorf("SetBatch left eviction collection on")
+	}
+}
@@ -0,0 +1,37 @@
+package s4lru
+
+// ghostList remembers the keys, but not the values, of the most recently
+// evicted items
+type ghostList struct {
+	keys []string       // ring buffer of evicted keys
+	next int            // slot the next key is written to
+	slot map[string]int // key -> its slot in keys
+}
+
+func newGhostList(size int) *ghostList {
+	return &ghostList{
+		keys: make([]string, size),
+		slot: make(map[string]int, size),
+	}
+}
+
+// add records key, forgetting the oldest key if the list is full
+func (g *ghostList) add(key string) {
+	old := g.keys[g.next]
+	if s, ok := g.slot[old]; ok && s == g.next {
+		delete(g.slot, old)
+	}
+	g.keys[g.next] = key
+	g.slot[key] = g.next
+	g.next = (g.next + 1) % len(g.keys)
+}
+
+func (g *ghostList) contains(key string) bool {
+	_, ok := g.slot[key]
+	return ok
+}
+
+// remove forgets key.  Its slot is left in place and is reclaimed by add.
+func (g *ghostList) remove(key string) {
+	delete(g.slot, key)
+}
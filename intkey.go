@@ -0,0 +1,58 @@
+package s4lru
+
+import "encoding/binary"
+
+// IntKeyCache is a Cache keyed by integers.  Each key is stored as the 8
+// bytes of its big-endian encoding, so that every distinct key has a
+// distinct string and none needs more than 8 bytes.  The conversion costs an
+// 8 byte allocation per call: BenchmarkIntKey shows it about doubling the
+// time of a Get that hits, much as formatting the key with strconv does, so
+// callers that already hold their keys as strings should keep using Cache.
+type IntKeyCache struct {
+	c *Cache
+}
+
+// NewIntKey returns a new integer-keyed S4LRU cache with the given capacity
+// and options, as for New
+func NewIntKey(capacity int, opts ...Option) *IntKeyCache {
+	return &IntKeyCache{c: New(capacity, opts...)}
+}
+
+// intKey returns the string key id is stored under
+func intKey(id uint64) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], id)
+	return string(b[:])
+}
+
+// Get returns a value from the cache
+func (c *IntKeyCache) Get(id uint64) (interface{}, bool) {
+	return c.c.Get(intKey(id))
+}
+
+// Peek returns a value from the cache without promoting it
+func (c *IntKeyCache) Peek(id uint64) (interface{}, bool) {
+	return c.c.Peek(intKey(id))
+}
+
+// Set sets a value in the cache
+func (c *IntKeyCache) Set(id uint64, value interface{}) {
+	c.c.Set(intKey(id), value)
+}
+
+// Remove removes an item from the cache, returning the item and a boolean
+// indicating if it was found
+func (c *IntKeyCache) Remove(id uint64) (interface{}, bool) {
+	return c.c.Remove(intKey(id))
+}
+
+// Len returns the total number of items in the cache
+func (c *IntKeyCache) Len() int {
+	return c.c.Len()
+}
+
+// Cache returns the underlying cache, for its other methods.  Keys it
+// reports are in the encoding described on IntKeyCache.
+func (c *IntKeyCache) Cache() *Cache {
+	return c.c
+}
@@ -0,0 +1,84 @@
+package s4lru
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestIntKeyCache(t *testing.T) {
+
+	c := NewIntKey(64)
+
+	// neighbours, and values whose decimal or byte forms could be confused
+	ids := []uint64{0, 1, 255, 256, 1 << 32, math.MaxUint64}
+	for n, id := range ids {
+		c.Set(id, n)
+	}
+	if c.Len() != len(ids) {
+		t.Fatalf("Len()=%d, want %d distinct keys", c.Len(), len(ids))
+	}
+	for n, id := range ids {
+		if v, ok := c.Get(id); !ok || v != n {
+			t.Errorf("Get(%d)=(%v,%v), want (%d,true)", id, v, ok, n)
+		}
+	}
+
+	if _, ok := c.Get(2); ok {
+		t.Errorf("Get of an id never set hit")
+	}
+	if v, ok := c.Remove(256); !ok || v != 3 {
+		t.Errorf("Remove(256)=(%v,%v), want (3,true)", v, ok)
+	}
+	if _, ok := c.Peek(256); ok {
+		t.Errorf("Peek found a removed id")
+	}
+	if _, ok := c.Peek(255); !ok {
+		t.Errorf("removing 256 disturbed 255")
+	}
+}
+
+// BenchmarkIntKey compares an integer-keyed Get with a Get on keys already
+// held as strings, and with converting the integers with strconv
+func BenchmarkIntKey(b *testing.B) {
+
+	const n = 1 << 10
+
+	b.Run("uint64", func(b *testing.B) {
+		c := NewIntKey(n)
+		for id := uint64(0); id < n; id++ {
+			c.Set(id, nil)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			c.Get(uint64(i) & (n - 1))
+		}
+	})
+
+	b.Run("strconv", func(b *testing.B) {
+		c := New(n)
+		for id := uint64(0); id < n; id++ {
+			c.Set(strconv.FormatUint(id, 10), nil)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			c.Get(strconv.FormatUint(uint64(i)&(n-1), 10))
+		}
+	})
+
+	b.Run("string", func(b *testing.B) {
+		c := New(n)
+		keys := make([]string, n)
+		for id := range keys {
+			keys[id] = intKey(uint64(id))
+			c.Set(keys[id], nil)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			c.Get(keys[i&(n-1)])
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package s4lru
+
+import "fmt"
+
+// checkInvariants verifies the internal consistency of the cache: every
+// segment's links and length agree, every linked item is a real slot of
+// c.items in the map under its own key and records the right segment, no
+// segment is over capacity, nothing is in the map that isn't linked into a
+// segment, and the free list holds only released slots that no segment links.
+//
+// The segments link items by index rather than holding interface values, so
+// there is no type assertion that a foreign value could make fail; an index
+// that points outside c.items, at the reserved slot 0, or at a freed slot is
+// the equivalent mistake, and is what this catches.
+func (c *Cache) checkInvariants() error {
+	inList := make(map[int32]bool, c.count())
+	linked := 0
+	for seg := range c.lists {
+		l := &c.lists[seg]
+		n := 0
+		cost := int64(0)
+		prev := int32(0)
+		for i := l.head; i != 0; i = c.items[i].next {
+			if i < 0 || int(i) >= len(c.items) {
+				return fmt.Errorf("segment %d: links index %d outside items[1:%d]", seg, i, len(c.items))
+			}
+			if inList[i] {
+				return fmt.Errorf("segment %d: item %d linked twice", seg, i)
+			}
+			inList[i] = true
+			item := &c.items[i]
+			if item.prev != prev {
+				return fmt.Errorf("segment %d: item %d (%q) has prev %d, want %d", seg, i, item.key, item.prev, prev)
+			}
+			if item.lidx != seg {
+				return fmt.Errorf("segment %d: item %d (%q) has lidx %d", seg, i, item.key, item.lidx)
+			}
+			if j, ok := c.getStored(item.key); !ok || j != i {
+				return fmt.Errorf("segment %d: item %d (%q) maps to %d, %v", seg, i, item.key, j, ok)
+			}
+			prev = i
+			n++
+			cost += item.cost
+			if n > len(c.items) {
+				return fmt.Errorf("segment %d: cycle", seg)
+			}
+		}
+		if l.tail != prev {
+			return fmt.Errorf("segment %d: tail %d, want %d", seg, l.tail, prev)
+		}
+		if l.len != n {
+			return fmt.Errorf("segment %d: len %d, but %d items linked", seg, l.len, n)
+		}
+		if l.cost != cost {
+			return fmt.Errorf("segment %d: cost %d, but items cost %d", seg, l.cost, cost)
+		}
+		if c.costFn != nil {
+			if cost > c.costCaps[seg] && !(seg == 0 && c.inUse > 0) {
+				return fmt.Errorf("segment %d: cost %d, budget %d", seg, cost, c.costCaps[seg])
+			}
+		} else if max := c.caps[seg] + c.excess(seg); n > max && !(seg == 0 && n <= max+c.inUse) && !c.unbounded {
+			return fmt.Errorf("segment %d: %d items, capacity %d", seg, n, max)
+		}
+		linked += n
+	}
+
+	if linked != c.count() {
+		return fmt.Errorf("%d items linked, %d in the map", linked, c.count())
+	}
+
+	free := 0
+	for i := c.free; i != 0; i = c.items[i].next {
+		if i < 0 || int(i) >= len(c.items) {
+			return fmt.Errorf("free list: index %d outside items[1:%d]", i, len(c.items))
+		}
+		if inList[i] {
+			return fmt.Errorf("free list: item %d is also linked into segment %d", i, c.items[i].lidx)
+		}
+		if c.items[i].key != "" || c.items[i].value != nil {
+			return fmt.Errorf("free list: item %d still holds %q", i, c.items[i].key)
+		}
+		free++
+		if free > len(c.items) {
+			return fmt.Errorf("free list: cycle")
+		}
+	}
+	if linked+free != len(c.items)-1 {
+		return fmt.Errorf("%d items linked and %d free, but %d allocated", linked, free, len(c.items)-1)
+	}
+
+	if c.costFn == nil && c.Len() > c.Capacity()+c.excess(0)+c.inUse && !c.unbounded {
+		return fmt.Errorf("Len()=%d exceeds Capacity()=%d", c.Len(), c.Capacity())
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package s4lru
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// randomOps applies n random operations over a small key space to c,
+// checking the invariants after each one
+func randomOps(t *testing.T, c *Cache, r *rand.Rand, n int) {
+	t.Helper()
+	for op := 0; op < n; op++ {
+		key := strconv.Itoa(r.Intn(3 * c.Capacity()))
+		switch r.Intn(6) {
+		case 0, 1:
+			c.Set(key, op)
+		case 2, 3, 4:
+			c.Get(key)
+		case 5:
+			c.Remove(key)
+		}
+		if err := c.checkInvariants(); err != nil {
+			t.Fatalf("after op %d: %v", op, err)
+		}
+	}
+}
+
+func TestInvariants(t *testing.T) {
+
+	configs := []func() *Cache{
+		func() *Cache { return New(4) },
+		func() *Cache { return New(16) },
+		func() *Cache { return NewWithSegments([]int{3, 0, 2, 5}) },
+		func() *Cache { return New(16, WithRebalanceOnRemove()) },
+		func() *Cache { return New(16, WithAdaptive(7)) },
+		func() *Cache { return New(16, WithGhost(8)) },
+		func() *Cache { return New(16, WithSoftLimit(24)) },
+		func() *Cache { return New(16, WithEvictionBatch(3)) },
+		func() *Cache { return New(16, WithAdmissionOrder(LIFO)) },
+		func() *Cache { return New(3, WithAdmissionOrder(FIFO)) },
+		func() *Cache { return NewWithSegments([]int{1, 6, 2, 3}, WithMinAdmission(4), WithAdaptive(5)) },
+		func() *Cache { return New(16, WithPromoteThreshold(2)) },
+	}
+
+	for seed := int64(0); seed < 20; seed++ {
+		for _, config := range configs {
+			randomOps(t, config(), rand.New(rand.NewSource(seed)), 2000)
+		}
+	}
+}
+
+// TestInvariantsBulk runs the operations that relink many items at once,
+// which the random walk in TestInvariants doesn't reach
+func TestInvariantsBulk(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+
+	c := New(16)
+	check := func(op string) {
+		t.Helper()
+		if err := c.checkInvariants(); err != nil {
+			t.Fatalf("after %s: %v", op, err)
+		}
+	}
+
+	randomOps(t, c, r, 500)
+	c.Reshape(6)
+	check("Reshape(6)")
+	randomOps(t, c, r, 500)
+	c.Reshape(2)
+	check("Reshape(2)")
+
+	c.SetWithSegment("top", 1, 1)
+	c.MoveToSegment("top", 0)
+	check("SetWithSegment/MoveToSegment")
+
+	c.ResetSegment(1)
+	check("ResetSegment")
+	randomOps(t, c, r, 500)
+
+	c.Restore(c.Snapshot())
+	check("Restore")
+	randomOps(t, c, r, 500)
+}
+
+// TestReferenceModel runs random operations against a cache and a plain map
+// of the values last stored.  The model doesn't predict evictions but is told
+// of them by OnEvict, so the two must always hold the same keys and values,
+// and the cache must only evict once segment 0 is full.
+func TestReferenceModel(t *testing.T) {
+
+	for seed := int64(0); seed < 10; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		c := New(16, WithGhost(4)) // 4 per segment
+		model := make(map[string]int)
+
+		op := 0
+		c.OnEvict = func(key string, value interface{}) {
+			if want, live := model[key]; !live || value != want {
+				t.Fatalf("seed %d op %d: evicted %s=%v, model has (%v,%v)", seed, op, key, value, want, live)
+			}
+			if len(model) < c.caps[0] {
+				t.Fatalf("seed %d op %d: evicted %s with only %d keys live", seed, op, key, len(model))
+			}
+			delete(model, key)
+		}
+
+		for ; op < 5000; op++ {
+			// alternate between a key space that fits in segment 0 and
+			// one that forces evictions
+			space := 4
+			if op/500%2 == 1 {
+				space = 64
+			}
+			key := strconv.Itoa(r.Intn(space))
+
+			switch r.Intn(5) {
+			case 0, 1:
+				c.Set(key, op)
+				model[key] = op
+			case 2, 3:
+				v, ok := c.Get(key)
+				want, live := model[key]
+				if ok != live || ok && v != want {
+					t.Fatalf("seed %d op %d: Get(%s)=(%v,%v), model has (%v,%v)", seed, op, key, v, ok, want, live)
+				}
+			case 4:
+				v, ok := c.Remove(key)
+				want, live := model[key]
+				if ok != live || ok && v != want {
+					t.Fatalf("seed %d op %d: Remove(%s)=(%v,%v), model has (%v,%v)", seed, op, key, v, ok, want, live)
+				}
+				delete(model, key)
+			}
+
+			if c.Len() != len(model) {
+				t.Fatalf("seed %d op %d: Len()=%d, model has %d keys", seed, op, c.Len(), len(model))
+			}
+			for k := range model {
+				if !c.Contains(k) {
+					t.Fatalf("seed %d op %d: %s is missing", seed, op, k)
+				}
+			}
+		}
+	}
+}
+
+// TestUpperSegmentsStayFull checks that promotion keeps the upper segments
+// full, as the algorithm assumes: an item only leaves a segment above 0 by
+// trading places with one coming up, or when the segment above is filled
+// by a demotion, so without Removes a segment that has filled never drains.
+func TestUpperSegmentsStayFull(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+	c := New(64)
+
+	// a skewed workload: hot keys are read often enough to climb to the
+	// top, and a stream of cold ones churns segment 0
+	key := func() string {
+		if r.Intn(2) == 0 {
+			return "hot" + strconv.Itoa(r.Intn(64))
+		}
+		return "cold" + strconv.Itoa(r.Intn(1000))
+	}
+
+	full := make([]bool, c.Segments())
+	for op := 0; op < 20000; op++ {
+		k := key()
+		if _, ok := c.Get(k); !ok {
+			c.Set(k, op)
+		}
+		for seg, n := range c.SegmentLens() {
+			if seg == 0 {
+				// hits promote out of it, until the next insert
+				continue
+			}
+			if n == c.caps[seg] {
+				full[seg] = true
+			} else if full[seg] {
+				t.Fatalf("op %d: segment %d drained to %d of %d", op, seg, n, c.caps[seg])
+			}
+		}
+	}
+
+	if got := c.SegmentLens(); !reflect.DeepEqual(got, c.caps) {
+		t.Errorf("SegmentLens()=%v after the workload, want every segment full at %v", got, c.caps)
+	}
+}
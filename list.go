@@ -0,0 +1,113 @@
+package s4lru
+
+// The segments are intrusive doubly-linked lists threaded through the
+// Cache.items slice.  Items refer to each other by index rather than pointer,
+// so they share a few contiguous allocations, the map values are plain
+// integers the garbage collector doesn't need to scan, and linking an item
+// into a list never allocates.  Index 0 is reserved so that the zero value
+// can mean "no item".
+
+// itemList is the head and tail of one segment
+type itemList struct {
+	head, tail int32
+	len        int
+	cost       int64  // total cost of the items, in cost mode
+	evictions  uint64 // items that left downwards, demoted or evicted
+}
+
+// Len returns the number of items in the list
+func (l *itemList) Len() int { return l.len }
+
+// alloc returns the index of an unused item, growing c.items if necessary.
+// Growing moves the items, so callers must not hold *cacheItem pointers
+// across a call to alloc.
+func (c *Cache) alloc() int32 {
+	if i := c.free; i != 0 {
+		c.free = c.items[i].next
+		c.items[i].next = 0
+		return i
+	}
+	c.items = append(c.items, cacheItem{})
+	return int32(len(c.items) - 1)
+}
+
+// release returns an unlinked item to the free list, dropping its key and
+// value so that they can be collected
+func (c *Cache) release(i int32) {
+	if x := c.items[i].extra; x != nil && x.refs > 0 {
+		// detach the count, so that outstanding release funcs do nothing
+		x.refs = 0
+		c.inUse--
+	}
+	c.items[i] = cacheItem{next: c.free}
+	c.free = i
+}
+
+// link inserts item i at the front of segment seg
+func (c *Cache) link(seg int, i int32) {
+	l := &c.lists[seg]
+	item := &c.items[i]
+	item.lidx = seg
+	item.prev = 0
+	item.next = l.head
+	if l.head != 0 {
+		c.items[l.head].prev = i
+	} else {
+		l.tail = i
+	}
+	l.head = i
+	l.len++
+	l.cost += item.cost
+	if seg > 0 && c.countStats {
+		c.reached(i, seg)
+	}
+}
+
+// linkBack inserts item i at the back of segment seg
+func (c *Cache) linkBack(seg int, i int32) {
+	l := &c.lists[seg]
+	item := &c.items[i]
+	item.lidx = seg
+	item.next = 0
+	item.prev = l.tail
+	if l.tail != 0 {
+		c.items[l.tail].next = i
+	} else {
+		l.head = i
+	}
+	l.tail = i
+	l.len++
+	l.cost += item.cost
+	if seg > 0 && c.countStats {
+		c.reached(i, seg)
+	}
+}
+
+// unlink removes item i from its segment
+func (c *Cache) unlink(i int32) {
+	item := &c.items[i]
+	l := &c.lists[item.lidx]
+	if item.prev != 0 {
+		c.items[item.prev].next = item.next
+	} else {
+		l.head = item.next
+	}
+	if item.next != 0 {
+		c.items[item.next].prev = item.prev
+	} else {
+		l.tail = item.prev
+	}
+	item.prev, item.next = 0, 0
+	l.len--
+	l.cost -= item.cost
+}
+
+// moveToFront moves item i to the front of its segment
+func (c *Cache) moveToFront(i int32) {
+	seg := c.items[i].lidx
+	if c.lists[seg].head == i {
+		return
+	}
+	c.unlink(i)
+	c.link(seg, i)
+}
@@ -0,0 +1,185 @@
+package s4lru
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Map is the index from keys to the slots holding their items.  By default
+// a Cache uses a builtin Go map; WithMap substitutes another implementation,
+// for example one with less per-entry overhead for very large caches.  Slots
+// are small positive integers assigned by the cache.  A Map need not be safe
+// for concurrent use, and Range is never called while the cache is changing
+// the map.
+type Map interface {
+	Load(key string) (slot int32, ok bool)
+	Store(key string, slot int32)
+	Delete(key string)
+	Len() int
+	Range(fn func(key string, slot int32) bool)
+}
+
+// WithMap makes the cache keep its index in m, which must be empty, instead
+// of a builtin map.  Behaviour is otherwise unchanged, though every lookup
+// pays for an interface call.
+func WithMap(m Map) Option {
+	return func(c *Cache) {
+		c.m = m
+		c.data = nil
+	}
+}
+
+// ErrKeyTooLong is returned by TrySet for a key longer than a cache created
+// WithMaxKeyLen accepts
+var ErrKeyTooLong = errors.New("s4lru: key too long")
+
+// storeKey returns key as it is to be stored, or false if it must be
+// rejected
+func (c *Cache) storeKey(key string) (string, bool) {
+	if c.foldKeys {
+		key = foldKey(key)
+	}
+	if c.maxKeyLen == 0 || len(key) <= c.maxKeyLen {
+		return key, true
+	}
+	if !c.truncateKeys {
+		return "", false
+	}
+	return string([]byte(c.truncate(key))), true
+}
+
+// indexKey returns key as it is looked up in the index.  It leaves a key
+// already normalized unchanged, but keys read back from items are looked up
+// with getStored and delStored instead, which skip it.
+func (c *Cache) indexKey(key string) string {
+	if c.foldKeys {
+		key = foldKey(key)
+	}
+	if c.truncateKeys && len(key) > c.maxKeyLen {
+		return c.truncate(key)
+	}
+	return key
+}
+
+// truncate cuts key, longer than maxKeyLen, to at most maxKeyLen bytes,
+// backing up to the start of a rune so that a truncated key is still valid
+// UTF-8 if key was: otherwise folding it again would change it
+func (c *Cache) truncate(key string) string {
+	n := c.maxKeyLen
+	for n > 0 && !utf8.RuneStart(key[n]) {
+		n--
+	}
+	return key[:n]
+}
+
+// foldKey returns the canonical case folding of key: each rune is replaced
+// by the lower case of the smallest rune it folds to, so that two keys fold
+// to the same string exactly when strings.EqualFold reports them equal.
+// Keys with no upper case ASCII and no other non-ASCII runes are returned
+// without allocating.
+func foldKey(key string) string {
+	i := 0
+	for ; i < len(key); i++ {
+		if b := key[i]; b >= utf8.RuneSelf || 'A' <= b && b <= 'Z' {
+			break
+		}
+	}
+	if i == len(key) {
+		return key
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(key))
+	sb.WriteString(key[:i])
+	for _, r := range key[i:] {
+		min := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+		sb.WriteRune(unicode.ToLower(min))
+	}
+	return sb.String()
+}
+
+// The index is only accessed through the methods below, which use the
+// builtin map directly unless WithMap was given.
+
+func (c *Cache) get(key string) (int32, bool) {
+	return c.getStored(c.indexKey(key))
+}
+
+// getStored is get for a key as stored in an item, which is already
+// normalized
+func (c *Cache) getStored(key string) (int32, bool) {
+	if c.m != nil {
+		return c.m.Load(key)
+	}
+	i, ok := c.data[key]
+	return i, ok
+}
+
+// slot returns the index of key's item, or 0 if it isn't present
+func (c *Cache) slot(key string) int32 {
+	i, _ := c.get(key)
+	return i
+}
+
+func (c *Cache) put(key string, i int32) {
+	if c.m != nil {
+		c.m.Store(key, i)
+		return
+	}
+	c.data[key] = i
+}
+
+func (c *Cache) del(key string) {
+	c.delStored(c.indexKey(key))
+}
+
+// delStored is del for a key as stored in an item
+func (c *Cache) delStored(key string) {
+	if c.m != nil {
+		c.m.Delete(key)
+		return
+	}
+	delete(c.data, key)
+}
+
+func (c *Cache) count() int {
+	if c.m != nil {
+		return c.m.Len()
+	}
+	return len(c.data)
+}
+
+func (c *Cache) each(fn func(key string, i int32) bool) {
+	if c.m != nil {
+		c.m.Range(fn)
+		return
+	}
+	for key, i := range c.data {
+		if !fn(key, i) {
+			return
+		}
+	}
+}
+
+// clear empties the index
+func (c *Cache) clear() {
+	if c.m == nil {
+		c.data = make(map[string]int32, c.Capacity())
+		return
+	}
+	var keys []string
+	c.m.Range(func(key string, _ int32) bool {
+		keys = append(keys, key)
+		return true
+	})
+	for _, key := range keys {
+		c.m.Delete(key)
+	}
+}
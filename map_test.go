@@ -0,0 +1,223 @@
+package s4lru
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// sliceMap is a Map kept as a sorted slice, standing in for a compact
+// replacement index
+type sliceMap struct {
+	keys  []string
+	slots []int32
+}
+
+func (m *sliceMap) find(key string) (int, bool) {
+	n := sort.SearchStrings(m.keys, key)
+	return n, n < len(m.keys) && m.keys[n] == key
+}
+
+func (m *sliceMap) Load(key string) (int32, bool) {
+	if n, ok := m.find(key); ok {
+		return m.slots[n], true
+	}
+	return 0, false
+}
+
+func (m *sliceMap) Store(key string, slot int32) {
+	n, ok := m.find(key)
+	if ok {
+		m.slots[n] = slot
+		return
+	}
+	m.keys = append(m.keys, "")
+	m.slots = append(m.slots, 0)
+	copy(m.keys[n+1:], m.keys[n:])
+	copy(m.slots[n+1:], m.slots[n:])
+	m.keys[n], m.slots[n] = key, slot
+}
+
+func (m *sliceMap) Delete(key string) {
+	if n, ok := m.find(key); ok {
+		m.keys = append(m.keys[:n], m.keys[n+1:]...)
+		m.slots = append(m.slots[:n], m.slots[n+1:]...)
+	}
+}
+
+func (m *sliceMap) Len() int { return len(m.keys) }
+
+func (m *sliceMap) Range(fn func(key string, slot int32) bool) {
+	for n := range m.keys {
+		if !fn(m.keys[n], m.slots[n]) {
+			return
+		}
+	}
+}
+
+func TestWithMap(t *testing.T) {
+
+	m := &sliceMap{}
+	c := New(16, WithMap(m))
+
+	for i := 0; i < 4; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	if m.Len() != 4 || c.Len() != 4 {
+		t.Fatalf("map holds %d keys, cache %d; want 4", m.Len(), c.Len())
+	}
+
+	if v, ok := c.Get("2"); !ok || v != 2 {
+		t.Errorf("Get(2)=(%v,%v), want (2,true)", v, ok)
+	}
+
+	c.Remove("2")
+	if _, ok := m.Load("2"); ok {
+		t.Errorf("removed key still in map")
+	}
+
+	entries := c.Snapshot()
+	c.Restore(entries)
+	if m.Len() != 3 {
+		t.Errorf("after Restore map holds %d keys, want 3", m.Len())
+	}
+
+	randomOps(t, New(16, WithMap(&sliceMap{})), rand.New(rand.NewSource(1)), 2000)
+}
+
+func TestMaxKeyLen(t *testing.T) {
+
+	long := "0123456789abcdef"
+
+	c := New(16, WithMaxKeyLen(8, RejectLongKeys))
+	c.Set(long, 1)
+	c.SetWithSegment(long, 1, 2)
+	c.Restore([]Entry{{Key: long, Value: 1}})
+	if c.Len() != 0 || c.Contains(long) {
+		t.Errorf("stored an over-length key")
+	}
+	if err := c.TrySet(long, 1); err != ErrKeyTooLong {
+		t.Errorf("TrySet(long) err=%v, want ErrKeyTooLong", err)
+	}
+	if err := c.TrySet(long[:8], 1); err != nil {
+		t.Errorf("TrySet of a key at the limit: %v", err)
+	}
+
+	c = New(16, WithMaxKeyLen(8, TruncateLongKeys))
+	c.Set(long, 1)
+	if got := c.EvictionOrder(); len(got) != 1 || got[0] != long[:8] {
+		t.Errorf("stored keys %v, want [%s]", got, long[:8])
+	}
+	if v, ok := c.Get(long); !ok || v != 1 {
+		t.Errorf("Get(long)=(%v,%v), want the truncated item", v, ok)
+	}
+	c.Set(long[:8]+"zz", 2) // shares the prefix
+	if v, _ := c.Get(long); c.Len() != 1 || v != 2 {
+		t.Errorf("keys sharing a truncated prefix weren't treated as one")
+	}
+	if _, ok := c.Remove(long); !ok || c.Len() != 0 {
+		t.Errorf("Remove(long) didn't remove the truncated key")
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFoldKeys(t *testing.T) {
+
+	c := New(16, WithFoldKeys())
+
+	c.Set("Café", 1)
+	for _, key := range []string{"café", "CAFÉ", "cAfÉ"} {
+		if v, ok := c.Get(key); !ok || v != 1 {
+			t.Errorf("Get(%q)=(%v,%v), want (1,true)", key, v, ok)
+		}
+	}
+	c.Set("CAFÉ", 2)
+	if got := c.EvictionOrder(); len(got) != 1 || got[0] != "café" {
+		t.Errorf("stored keys %v, want [café]", got)
+	}
+
+	// keys that only fold together through a third form
+	c.Set("ΣΊΣΥΦΟΣ", 3)
+	if v, ok := c.Get("σίσυφος"); !ok || v != 3 {
+		t.Errorf("Get(σίσυφος)=(%v,%v), want (3,true)", v, ok)
+	}
+	c.Set("K", 4) // KELVIN SIGN
+	if v, ok := c.Get("k"); !ok || v != 4 {
+		t.Errorf("Get(k)=(%v,%v), want the Kelvin sign's item", v, ok)
+	}
+
+	// folding isn't normalization
+	if c.Contains("cafe\u0301") {
+		t.Errorf("a decomposed é matched the precomposed key")
+	}
+
+	if _, ok := c.Remove("CaFé"); !ok || c.Contains("café") {
+		t.Errorf("Remove(CaFé) didn't remove café")
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	for _, key := range []string{"ÉCOLE", "straße", "ǅ", "abc", "ΣΊΣΥΦΟΣ"} {
+		if f := foldKey(key); foldKey(f) != f {
+			t.Errorf("foldKey(%q)=%q isn't stable", key, f)
+		}
+	}
+}
+
+func BenchmarkFoldKeys(b *testing.B) {
+
+	for _, bb := range []struct {
+		name string
+		key  string
+		opts []Option
+	}{
+		{"off", "Café-1234", nil},
+		{"lower", "cafe-1234", []Option{WithFoldKeys()}},
+		{"mixed", "Café-1234", []Option{WithFoldKeys()}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			c := New(16, bb.opts...)
+			c.Set(bb.key, 1)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Get(bb.key)
+			}
+		})
+	}
+}
+
+func TestFoldTruncatedKeys(t *testing.T) {
+
+	c := New(4, WithFoldKeys(), WithMaxKeyLen(2, TruncateLongKeys)) // 1 per segment
+
+	// "aé" is 3 bytes, so keeping 2 would split the é
+	c.Set("aé", "mine")
+	if got := c.EvictionOrder(); len(got) != 1 || got[0] != "a" {
+		t.Errorf("stored keys %q, want [a]", got)
+	}
+	if v, ok := c.Peek("AÉ"); !ok || v != "mine" {
+		t.Errorf("Peek(AÉ)=(%v,%v), want (mine,true)", v, ok)
+	}
+
+	c.Set("zz", "other") // evicts the truncated key, reusing its slot
+	if v, ok := c.Get("aé"); ok {
+		t.Errorf("Get(aé)=%v after it was evicted", v)
+	}
+	if c.Len() != 1 {
+		t.Errorf("Len()=%d, want 1", c.Len())
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	for _, key := range []string{"aé", "AÉé", "ab", "ΣΊΣ", "K"} {
+		if k := c.indexKey(key); c.indexKey(k) != k {
+			t.Errorf("indexKey(%q)=%q isn't stable", key, k)
+		}
+	}
+}
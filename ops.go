@@ -0,0 +1,68 @@
+package s4lru
+
+// OpKind identifies the kind of an operation recorded WithRecentOps
+type OpKind int
+
+// The operations recorded WithRecentOps
+const (
+	OpGet    OpKind = iota // any of the Gets, including GetNoPromote and GetE
+	OpSet                  // any of the Sets
+	OpRemove               // Remove, once for each key of RemoveMulti
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpGet:
+		return "get"
+	case OpSet:
+		return "set"
+	case OpRemove:
+		return "remove"
+	}
+	return "unknown"
+}
+
+// Op is one operation recorded WithRecentOps
+type Op struct {
+	Kind OpKind
+	Key  string
+}
+
+// opRing holds the last len(ops) operations
+type opRing struct {
+	ops  []Op
+	next int  // slot the next op is written to
+	full bool // whether ops has wrapped around
+}
+
+func (r *opRing) add(kind OpKind, key string) {
+	r.ops[r.next] = Op{Kind: kind, Key: key}
+	r.next++
+	if r.next == len(r.ops) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// record notes an operation for RecentOps
+func (c *Cache) record(kind OpKind, key string) {
+	if c.recent != nil {
+		c.recent.add(kind, key)
+	}
+}
+
+// RecentOps returns the operations recorded by a cache created
+// WithRecentOps, oldest first, as a black-box record for working out how the
+// cache came to be in its current state.  It is nil for other caches.
+func (c *Cache) RecentOps() []Op {
+	r := c.recent
+	if r == nil {
+		return nil
+	}
+	if !r.full {
+		return append([]Op(nil), r.ops[:r.next]...)
+	}
+	ops := make([]Op, 0, len(r.ops))
+	ops = append(ops, r.ops[r.next:]...)
+	return append(ops, r.ops[:r.next]...)
+}
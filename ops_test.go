@@ -0,0 +1,35 @@
+package s4lru
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRecentOps(t *testing.T) {
+
+	c := New(8, WithRecentOps(4))
+
+	if ops := c.RecentOps(); len(ops) != 0 {
+		t.Errorf("RecentOps() of a new cache = %v", ops)
+	}
+
+	c.Set("a", 1)
+	c.Get("a")
+	want := []Op{{OpSet, "a"}, {OpGet, "a"}}
+	if ops := c.RecentOps(); !reflect.DeepEqual(ops, want) {
+		t.Errorf("RecentOps()=%v, want %v", ops, want)
+	}
+
+	c.Get("missing")
+	c.Remove("a")
+	c.SetWithSegment("b", 2, 1)
+	c.GetNoPromote("b")
+	want = []Op{{OpGet, "missing"}, {OpRemove, "a"}, {OpSet, "b"}, {OpGet, "b"}}
+	if ops := c.RecentOps(); !reflect.DeepEqual(ops, want) {
+		t.Errorf("RecentOps() after wrapping = %v, want %v", ops, want)
+	}
+
+	if ops := New(8).RecentOps(); ops != nil {
+		t.Errorf("recorded ops without WithRecentOps: %v", ops)
+	}
+}
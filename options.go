@@ -0,0 +1,360 @@
+package s4lru
+
+// An Option configures optional behaviour of a Cache when it is created
+type Option func(*Cache)
+
+func (c *Cache) apply(opts []Option) {
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.raiseAdmission()
+}
+
+// WithAdaptive enables adaptive segment sizing.  After every interval hits,
+// the cache compares the hits each segment received and moves one slot of
+// capacity from the least-hit segment to the most-hit one, so that segments
+// serving most of the traffic grow at the expense of idle ones.  The total
+// capacity is unchanged.  WithAdaptive will panic if interval is not
+// positive.
+//
+// To avoid thrashing, capacity only moves when the busiest segment saw at
+// least twice the hits of the idlest, no segment shrinks below one slot, and
+// the hit counts are halved rather than reset after each rebalance so that a
+// short burst can't undo a long-term trend.  Items displaced from a shrinking
+// segment cascade down as usual, so a rebalance may evict.
+func WithAdaptive(interval int) Option {
+	if interval <= 0 {
+		panic("s4lru: adaptive interval must be positive")
+	}
+	return func(c *Cache) {
+		c.adapt = &adaptive{interval: interval}
+	}
+}
+
+// WithRebalanceOnRemove makes Remove keep the upper segments full.  When an
+// item is removed from segment k > 0, the coldest item of segment k-1 is
+// pulled up to the back of segment k, and so on down, so that the free slot
+// ends up in segment 0 where the next insert can use it.
+//
+// This matches the algorithm's assumption that upper segments are full, at
+// the cost of O(segments) extra work per Remove, and of granting the pulled
+// up items protection from eviction they did not earn through a hit.
+func WithRebalanceOnRemove() Option {
+	return func(c *Cache) {
+		c.backfillOnRemove = true
+	}
+}
+
+// WithGhost keeps the keys of the last size evicted items in a ghost list.
+// A key that is Set again while it is still in the ghost list was evicted
+// too early: it skips the admission segment and is inserted directly into
+// segment 1, giving it a better chance of surviving than a cold new key.
+//
+// The ghost list holds keys only, never values, so its memory overhead is
+// roughly size times the key length plus a map entry, regardless of the size
+// of the cached values.  WithGhost will panic if size is not positive.
+func WithGhost(size int) Option {
+	if size <= 0 {
+		panic("s4lru: ghost list size must be positive")
+	}
+	return func(c *Cache) {
+		c.ghost = newGhostList(size)
+	}
+}
+
+// WithSoftLimit lets a burst of inserts grow the cache to limit items
+// before Set starts evicting.  The excess is held in segment 0, so Len may
+// exceed Capacity by up to limit-Capacity; each later Get evicts at most two
+// of the excess items from the back of segment 0, so that the cache drains
+// back to Capacity gradually once the burst gives way to reads rather than
+// all at once.  A limit no greater than Capacity has no effect.
+func WithSoftLimit(limit int) Option {
+	return func(c *Cache) {
+		c.softLimit = limit
+	}
+}
+
+// WithPromoteOnSet controls what Set does with a key that is already
+// present.  By default, or with promote true, replacing the value counts as
+// an access and promotes the item as Get does.  With promote false, the item
+// keeps its place, as with SetKeepSegment.
+func WithPromoteOnSet(promote bool) Option {
+	return func(c *Cache) {
+		c.noPromoteOnSet = !promote
+	}
+}
+
+// WithStats turns the hit, miss and eviction counters reported by Stats on
+// or off.  They are off by default for a Cache, sparing the hot path an
+// atomic update per operation, and on by default for a SyncCache, where the
+// cost is small next to taking the lock.
+func WithStats(enabled bool) Option {
+	return func(c *Cache) {
+		c.countStats = enabled
+	}
+}
+
+// WithDistinctKeys makes the cache count the distinct keys it has been asked
+// to store, as reported by DistinctKeysSeen, for estimating the size of the
+// working set against the capacity.  A key counts when it is inserted while
+// neither cached nor among the last recent keys to be evicted, removed or
+// expired, which are remembered as for WithGhost.  The count is therefore
+// approximate: a key that returns after more than recent others have left
+// the cache counts again.  WithDistinctKeys will panic if recent is not
+// positive.
+func WithDistinctKeys(recent int) Option {
+	if recent <= 0 {
+		panic("s4lru: recent key count must be positive")
+	}
+	return func(c *Cache) {
+		c.departed = newGhostList(recent)
+	}
+}
+
+// WithRecentOps makes the cache record its last n Gets, Sets and Removes,
+// with their keys, as reported by RecentOps for post-mortem debugging.  The
+// record costs n Ops plus the keys they keep alive, and an assignment per
+// operation.  WithRecentOps will panic if n is not positive.
+func WithRecentOps(n int) Option {
+	if n <= 0 {
+		panic("s4lru: recent op count must be positive")
+	}
+	return func(c *Cache) {
+		c.recent = &opRing{ops: make([]Op, n)}
+	}
+}
+
+// WithBypassRate makes roughly the fraction rate of keys always miss when
+// read, as if they weren't cached, for experiments measuring what the cache
+// saves, such as comparing the load on a backend with and without it.  Keys
+// are chosen by their hash, so the same key always bypasses the cache or
+// never does.  A bypassed read leaves any stored item untouched, but is
+// counted as a miss and, for GetE, loaded with the Loader and stored as on
+// any miss.  Only reads are affected: Sets store bypassed keys as usual.
+// WithBypassRate will panic if rate is outside [0, 1].
+func WithBypassRate(rate float64) Option {
+	if !(rate >= 0 && rate <= 1) {
+		panic("s4lru: bypass rate must be between 0 and 1")
+	}
+	return func(c *Cache) {
+		c.bypassBelow = uint64(rate * (1 << 32))
+	}
+}
+
+// An Order is the order segment 0 keeps its items in, which decides the
+// victim when it is full
+type Order int
+
+const (
+	// LRU evicts the least recently used item: new keys join the front
+	// of segment 0, as do items read without being promoted.  This is the
+	// default.
+	LRU Order = iota
+
+	// FIFO evicts the item that entered segment 0 first: reads that
+	// don't promote an item, as in a cache with a single segment, leave
+	// it where it is.  Items demoted into segment 0 join the front like
+	// new keys, so the order is that of arrival in segment 0; the list
+	// itself records it, so no insertion times are kept.  A cache with a
+	// single segment, NewWithSegments([]int{n}, WithAdmissionOrder(FIFO)),
+	// is a plain FIFO cache, for comparing S4LRU against on the same
+	// trace.  WithFIFOAdmission orders by first insertion instead.
+	FIFO
+
+	// LIFO evicts the newest key: new keys join the back of segment 0, so
+	// a key that isn't read again before the next insert is the next to
+	// go.  A scan of one-hit wonders then churns through a single slot
+	// instead of flushing segment 0, but a new key that will be reused
+	// only survives if it is read before another key arrives.  Items
+	// demoted into segment 0 still join the front.
+	LIFO
+)
+
+// WithAdmissionOrder sets the order segment 0 keeps its items in, and so
+// which item a full segment 0 evicts.  The upper segments are always LRU.
+func WithAdmissionOrder(order Order) Option {
+	return func(c *Cache) {
+		c.order = order
+	}
+}
+
+// WithFIFOAdmission makes a full segment 0 evict the item that was inserted
+// into the cache first, for comparing S4LRU against FIFO on the same trace.
+// Each item records a sequence number when it is inserted and keeps it
+// when it is promoted, demoted or has its value replaced, so an item
+// demoted back into segment 0 is as old as when it first arrived, not as
+// when it was demoted.  Finding the oldest item scans segment 0 on every
+// eviction, so this is meant for experiments rather than production.  A
+// VictimSelector takes precedence over it.
+func WithFIFOAdmission() Option {
+	return func(c *Cache) {
+		c.fifoAdmission = true
+	}
+}
+
+// WithEvictionChan makes the cache send every item it evicts to make room
+// for others on a channel with a buffer of n entries, as returned by
+// EvictionChan, so that evictions can be handled asynchronously, such as by
+// a write-back goroutine, instead of on the hot path by OnEvict.  Each Entry
+// records the segment the item was evicted from.  Items removed by Remove,
+// Clear or expiry aren't sent.  Sends never block: an eviction arriving when
+// the buffer is full is dropped and counted by EvictionsDropped, so a
+// consumer that falls behind loses evictions rather than slowing the cache,
+// and one that can't afford to lose any should use OnEvict instead.
+// WithEvictionChan will panic if n is not positive.
+func WithEvictionChan(n int) Option {
+	if n <= 0 {
+		panic("s4lru: eviction channel buffer must be positive")
+	}
+	return func(c *Cache) {
+		c.evictCh = make(chan Entry, n)
+	}
+}
+
+// WithPromoteThreshold makes an item climb a segment only on every nth
+// access, by Get, TouchMulti or Set, rather than on every one, so that a key
+// read a few times in a burst doesn't displace steadily popular ones.  Each
+// item counts its accesses since it entered its current segment; the other
+// accesses only move it to the front of that segment.  The count is kept
+// with the item's other optional state, allocated on its first access.
+// WithPromoteThreshold will panic if n is less than 1; 1 is the default.
+func WithPromoteThreshold(n int) Option {
+	if n < 1 {
+		panic("s4lru: promote threshold must be at least 1")
+	}
+	return func(c *Cache) {
+		c.promoteThreshold = n
+	}
+}
+
+// WithFoldKeys makes the cache ignore case in keys, using Unicode simple
+// case folding: Set, Get, Remove and every other method taking a key treat
+// keys that strings.EqualFold reports equal as the same key, so "CAFÉ",
+// "Café" and "café" share one entry.  Keys are stored folded, and reported
+// that way by Snapshot, OnEvict and the other methods returning keys.  Only
+// case is folded: a precomposed "é" and an "e" followed by a combining acute
+// accent remain different keys, so keys that may arrive in either form
+// should be normalized first.  Folding costs a scan of the key on every
+// call, and for keys containing upper case or non-ASCII letters an
+// allocation too, which makes a Get of such a key several times slower;
+// lower case ASCII keys pay only for the scan.
+func WithFoldKeys() Option {
+	return func(c *Cache) {
+		c.foldKeys = true
+	}
+}
+
+// WithMinAdmission gives segment 0, the admission segment, a capacity of at
+// least n, so that new items aren't evicted before they have had a chance to
+// be read again, as can happen when a small capacity or uneven caps leave it
+// only a slot or two.  The capacity it needs is taken from the upper
+// segments, one slot at a time from the largest; the total capacity is
+// unchanged, so a cache whose capacity is below n puts all of it in segment
+// 0.  The floor also holds through WithAdaptive resizing, Reshape and
+// Compact.  WithMinAdmission will panic if n is not positive.
+func WithMinAdmission(n int) Option {
+	if n <= 0 {
+		panic("s4lru: minimum admission capacity must be positive")
+	}
+	return func(c *Cache) {
+		c.minAdmission = n
+	}
+}
+
+// WithAccessCounts makes the cache count the Gets of each item, as reported
+// by AccessCount.
+func WithAccessCounts() Option {
+	return func(c *Cache) {
+		c.countAccess = true
+	}
+}
+
+// WithAccessTimes makes each item remember the times of its last k reads by
+// Get or GetNoPromote, as reported by AccessTimes, for experimenting with
+// LRU-K style policies.  Times come from the cache's Now function.  Each item
+// that has been read costs a ring of k timestamps.  WithAccessTimes will
+// panic if k is not positive.
+func WithAccessTimes(k int) Option {
+	if k <= 0 {
+		panic("s4lru: access time count must be positive")
+	}
+	return func(c *Cache) {
+		c.accessTimes = k
+	}
+}
+
+// WithSlidingTTL gives items set with a TTL a sliding expiration: each read
+// by Get or GetNoPromote pushes the item's expiry back to its original TTL
+// from now, as told by the cache's Now function.  Frequently read items stay
+// alive indefinitely while idle ones expire.  Items without a TTL are
+// unaffected.
+func WithSlidingTTL() Option {
+	return func(c *Cache) {
+		c.slidingTTL = true
+	}
+}
+
+// A VictimSelector chooses which item Set evicts when segment 0 is full.  It
+// is passed the keys in segment 0 from the least to the most recently used,
+// so returning keys[0] gives the default LRU behaviour.  Returning a key that
+// isn't among keys also falls back to LRU.  The selector may read the cache,
+// for example with AccessCount, but must not modify it.
+type VictimSelector func(keys []string) string
+
+// WithVictimSelector makes Set consult fn to pick the item to evict from a
+// full segment 0, instead of always evicting its least recently used item.
+// Items cascading down from the upper segments are unaffected.
+func WithVictimSelector(fn VictimSelector) Option {
+	return func(c *Cache) {
+		c.victim = fn
+	}
+}
+
+// WithEvictionBatch makes a full segment 0 evict its n least recently used
+// items in one pass, emptying it down to a low watermark of its capacity less
+// n, rather than evicting one item per insert.  Under a sustained stream of
+// inserts, evictions then come in a pass every n inserts; once the upper
+// segments are full, Len oscillates between Capacity-n and Capacity.  A
+// single eviction is already cheap, since Set reuses the evicted item in
+// place, so batching pays off mostly when a pass has fixed costs of its own.
+// Items are still chosen by the VictimSelector, if any, one at a time.
+// WithEvictionBatch will panic if n is not positive; a batch of 1 is the
+// default behaviour.
+func WithEvictionBatch(n int) Option {
+	if n <= 0 {
+		panic("s4lru: eviction batch must be positive")
+	}
+	return func(c *Cache) {
+		c.evictBatch = n
+	}
+}
+
+// A KeyPolicy says what a cache created WithMaxKeyLen does with longer keys
+type KeyPolicy int
+
+const (
+	// RejectLongKeys makes Set and the other writes drop a long key, and
+	// TrySet return ErrKeyTooLong for it.  Lookups of it simply miss.
+	RejectLongKeys KeyPolicy = iota
+
+	// TruncateLongKeys stores a long key cut to the maximum length,
+	// backing up to the start of a UTF-8 rune rather than splitting one,
+	// and lookups truncate keys the same way, so that keys sharing a long
+	// enough prefix are treated as one.
+	TruncateLongKeys
+)
+
+// WithMaxKeyLen limits the keys the cache stores to n bytes, dealing with
+// longer ones according to policy; by default there is no limit.  A
+// truncated key is copied, so that it doesn't keep the caller's long string
+// alive, and may end in the middle of a UTF-8 sequence.  WithMaxKeyLen will
+// panic if n is not positive.
+func WithMaxKeyLen(n int, policy KeyPolicy) Option {
+	if n <= 0 {
+		panic("s4lru: maximum key length must be positive")
+	}
+	return func(c *Cache) {
+		c.maxKeyLen = n
+		c.truncateKeys = policy == TruncateLongKeys
+	}
+}
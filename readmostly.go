@@ -0,0 +1,119 @@
+package s4lru
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ReadMostlyCache is an S4LRU cache, safe for concurrent access, whose Gets
+// take no lock at all.  They read an immutable snapshot of the cache's
+// contents, which every Set or Remove replaces with a fresh copy.  Reads
+// scale with the number of goroutines making them, while every write costs
+// time proportional to the size of the cache, so it suits caches read far
+// more often than they change.
+//
+// A Get can't promote anything without a lock, so it only marks the key as
+// read in the snapshot.  The marked keys are promoted together, once each
+// however often they were read, by the next Set, Remove or Flush, before it
+// makes its own change.  Promotion is therefore coarser than in a SyncCache:
+// the number of reads of a key since the last write is lost, and so is
+// their order.  Values are returned until they are removed or evicted;
+// expiry isn't supported.
+type ReadMostlyCache struct {
+	mu   sync.Mutex // held by writers
+	c    *Cache
+	snap atomic.Pointer[map[string]*readEntry] // replaced by every write
+}
+
+// readEntry is a value in a ReadMostlyCache snapshot
+type readEntry struct {
+	value interface{}
+	read  uint32 // set by a Get since the snapshot was taken, atomic
+}
+
+// NewReadMostly returns a new ReadMostlyCache with the given capacity and
+// options, as for New
+func NewReadMostly(capacity int, opts ...Option) *ReadMostlyCache {
+	r := &ReadMostlyCache{c: New(capacity, opts...)}
+	r.snap.Store(&map[string]*readEntry{})
+	return r
+}
+
+// Get returns a value from the cache without taking a lock.  The key's
+// promotion is deferred to the next write or Flush.
+func (r *ReadMostlyCache) Get(key string) (interface{}, bool) {
+	e, ok := r.snapshot()[r.c.indexKey(key)]
+	if !ok {
+		return nil, false
+	}
+	if atomic.LoadUint32(&e.read) == 0 {
+		atomic.StoreUint32(&e.read, 1)
+	}
+	return e.value, true
+}
+
+// Set sets a value in the cache, first applying the promotions deferred by
+// Gets since the last write
+func (r *ReadMostlyCache) Set(key string, value interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.promote()
+	r.c.Set(key, value)
+	r.publish()
+}
+
+// Remove removes key from the cache, first applying the promotions deferred
+// by Gets since the last write, and returns the value it held
+func (r *ReadMostlyCache) Remove(key string) (interface{}, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.promote()
+	v, ok := r.c.Remove(key)
+	if ok {
+		r.publish()
+	}
+	return v, ok
+}
+
+// Flush applies the promotions deferred by Gets since the last write, as
+// the next write would, for callers that write too rarely for promotion to
+// keep up with their reads
+func (r *ReadMostlyCache) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.promote()
+}
+
+// Len returns the number of items in the cache, without taking a lock
+func (r *ReadMostlyCache) Len() int {
+	return len(r.snapshot())
+}
+
+func (r *ReadMostlyCache) snapshot() map[string]*readEntry {
+	return *r.snap.Load()
+}
+
+// promote promotes each key read since the snapshot was taken, once, and
+// clears its mark.  The caller must hold the lock.
+func (r *ReadMostlyCache) promote() {
+	for key, e := range r.snapshot() {
+		if atomic.LoadUint32(&e.read) == 0 {
+			continue
+		}
+		atomic.StoreUint32(&e.read, 0)
+		if i, ok := r.c.getStored(key); ok {
+			r.c.hit(i)
+		}
+	}
+}
+
+// publish replaces the snapshot with a copy of the cache's contents.  The
+// caller must hold the lock.
+func (r *ReadMostlyCache) publish() {
+	m := make(map[string]*readEntry, r.c.count())
+	r.c.each(func(key string, i int32) bool {
+		m[key] = &readEntry{value: r.c.items[i].value}
+		return true
+	})
+	r.snap.Store(&m)
+}
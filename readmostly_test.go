@@ -0,0 +1,151 @@
+package s4lru
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestReadMostly(t *testing.T) {
+
+	r := NewReadMostly(8) // 2 per segment
+	r.Set("a", 1)
+	r.Set("b", 2)
+
+	seg := func(key string) int { return r.c.items[r.c.slot(key)].lidx }
+
+	// reads are deferred: three Gets promote a once, at the next write
+	for n := 0; n < 3; n++ {
+		if v, ok := r.Get("a"); !ok || v != 1 {
+			t.Fatalf("Get(a)=(%v,%v), want (1,true)", v, ok)
+		}
+	}
+	if seg("a") != 0 {
+		t.Errorf("a promoted by a Get before any write")
+	}
+	r.Flush()
+	if seg("a") != 1 {
+		t.Errorf("a in segment %d after Flush, want 1", seg("a"))
+	}
+	r.Flush()
+	if seg("a") != 1 {
+		t.Errorf("a promoted again without being read")
+	}
+
+	// a promotion deferred to a Set is applied before its eviction
+	r.Get("b")
+	r.Set("c", 3)
+	r.Set("d", 4)
+	r.Set("e", 5)
+	if _, ok := r.Get("b"); !ok {
+		t.Errorf("b, read before the Sets, was evicted")
+	}
+	if _, ok := r.Get("c"); ok {
+		t.Errorf("c survived as the coldest key")
+	}
+
+	if v, ok := r.Remove("b"); !ok || v != 2 {
+		t.Errorf("Remove(b)=(%v,%v), want (2,true)", v, ok)
+	}
+	if _, ok := r.Get("b"); ok || r.Len() != 3 {
+		t.Errorf("after Remove(b): Get(b) ok=%v, Len()=%d, want false and 3", ok, r.Len())
+	}
+	if err := r.c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadMostlyConcurrent(t *testing.T) {
+
+	r := NewReadMostly(64)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for k := 0; k < 16; k++ {
+					key := strconv.Itoa(k)
+					if v, ok := r.Get(key); ok && v != k {
+						t.Errorf("Get(%s)=%v", key, v)
+					}
+				}
+			}
+		}()
+	}
+
+	for n := 0; n < 2000; n++ {
+		k := n % 16
+		if n%5 == 4 {
+			r.Remove(strconv.Itoa(k))
+		} else {
+			r.Set(strconv.Itoa(k), k)
+		}
+		if n%7 == 0 {
+			r.Flush()
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if err := r.c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+// BenchmarkReadMostly compares parallel Get throughput of a ReadMostlyCache
+// and a SyncCache holding the same keys, with a write every writeEvery reads
+// in the mixed case
+func BenchmarkReadMostly(b *testing.B) {
+
+	const capacity = 1 << 10
+
+	type cache interface {
+		Get(key string) (interface{}, bool)
+		Set(key string, value interface{})
+	}
+
+	trace := benchTrace(capacity, 1<<16)
+
+	for _, cc := range []struct {
+		name string
+		new  func() cache
+	}{
+		{"sync", func() cache { return NewSync(capacity) }},
+		{"readmostly", func() cache { return NewReadMostly(capacity) }},
+	} {
+		for _, writeEvery := range []int{0, 10000} {
+			name := cc.name + "/reads"
+			if writeEvery > 0 {
+				name += "+writes"
+			}
+			b.Run(name, func(b *testing.B) {
+				c := cc.new()
+				for _, key := range trace[:capacity] {
+					c.Set(key, key)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := 0
+					for pb.Next() {
+						key := trace[i%len(trace)]
+						if writeEvery > 0 && i%writeEvery == 0 {
+							c.Set(key, key)
+						} else {
+							c.Get(key)
+						}
+						i++
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package s4lru
+
+// Repair scans the cache for internal inconsistencies and fixes them,
+// returning the number of repairs made; 0 means the cache was consistent.
+// It is a safety net for long-running services, not something a correct
+// program needs, and takes O(n) time and memory.
+//
+// Each segment keeps the items it links, in order, for which the map agrees;
+// items the map doesn't point to are dropped, and so are map entries that
+// point to no linked item.  Segment links, lengths, costs and each item's
+// record of its segment are then rebuilt, a segment found over capacity
+// cascades down as usual, and every slot that isn't linked is returned to
+// the free list.  Dropped items are not reported to OnEvict.
+func (c *Cache) Repair() int {
+	repairs := 0
+	kept := make(map[int32]bool, c.count())
+
+	for seg := range c.lists {
+		l := &c.lists[seg]
+
+		// collect the segment's items, stopping at a bad index or a cycle
+		var order []int32
+		seen := make(map[int32]bool)
+		for i := l.head; i != 0; i = c.items[i].next {
+			if i < 0 || int(i) >= len(c.items) || seen[i] || kept[i] {
+				repairs++
+				break
+			}
+			seen[i] = true
+			if j, ok := c.getStored(c.items[i].key); !ok || j != i {
+				repairs++ // orphan: the map doesn't know about it
+				continue
+			}
+			order = append(order, i)
+		}
+
+		// relink the survivors
+		var cost int64
+		prev := int32(0)
+		for n, i := range order {
+			item := &c.items[i]
+			next := int32(0)
+			if n+1 < len(order) {
+				next = order[n+1]
+			}
+			if item.prev != prev || item.next != next || item.lidx != seg {
+				repairs++
+			}
+			item.prev, item.next, item.lidx = prev, next, seg
+			cost += item.cost
+			kept[i] = true
+			prev = i
+		}
+		head := int32(0)
+		if len(order) > 0 {
+			head = order[0]
+		}
+		want := itemList{head: head, tail: prev, len: len(order), cost: cost, evictions: l.evictions}
+		if *l != want {
+			repairs++
+			*l = want
+		}
+	}
+
+	var stale []string
+	c.each(func(key string, i int32) bool {
+		if !kept[i] || c.items[i].key != key {
+			stale = append(stale, key)
+		}
+		return true
+	})
+	for _, key := range stale {
+		c.delStored(key)
+		repairs++
+	}
+
+	c.free = 0
+	for i := int32(len(c.items)) - 1; i > 0; i-- {
+		if !kept[i] {
+			c.release(i)
+		}
+	}
+
+	for seg := len(c.lists) - 1; seg >= 0; seg-- {
+		if c.over(seg) {
+			repairs++
+			c.cascade(seg)
+			break
+		}
+	}
+
+	return repairs
+}
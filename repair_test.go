@@ -0,0 +1,48 @@
+package s4lru
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+
+	c := New(16)
+	randomOps(t, c, rand.New(rand.NewSource(1)), 500)
+
+	if n := c.Repair(); n != 0 {
+		t.Errorf("Repair() of a consistent cache made %d repairs", n)
+	}
+
+	// break it in a few ways
+	var linked []int32
+	for seg := range c.lists {
+		for i := c.lists[seg].head; i != 0; i = c.items[i].next {
+			linked = append(linked, i)
+		}
+	}
+	if len(linked) < 3 {
+		t.Fatalf("only %d items to break", len(linked))
+	}
+
+	c.items[linked[0]].lidx++              // wrong segment recorded
+	delete(c.data, c.items[linked[1]].key) // orphaned list item
+	c.data["dangling"] = linked[2]         // map entry for the wrong item
+	c.lists[len(c.lists)-1].len += 5       // wrong length
+	if err := c.checkInvariants(); err == nil {
+		t.Fatalf("checkInvariants didn't notice the damage")
+	}
+
+	if n := c.Repair(); n < 4 {
+		t.Errorf("Repair() made %d repairs, want at least 4", n)
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Errorf("after Repair: %v", err)
+	}
+	if _, ok := c.Peek("dangling"); ok {
+		t.Errorf("Repair kept a map entry for the wrong item")
+	}
+
+	// and the cache still works
+	randomOps(t, c, rand.New(rand.NewSource(2)), 500)
+}
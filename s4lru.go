@@ -16,117 +16,1791 @@ From http://www.cs.cornell.edu/~qhuang/papers/sosp_fbanalysis.pdf
 */
 package s4lru
 
-import "container/list"
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
 
+// cacheItem is one slot of the cache.  It costs 64 bytes on 64-bit
+// platforms, plus its map entry; the cost field is the only one reserved for
+// an optional feature, since the segments update their totals from it on
+// every link and unlink.
 type cacheItem struct {
+	prev  int32 // index of the previous item in its segment, or 0
+	next  int32 // index of the next item in its segment, or 0
 	lidx  int
 	key   string
 	value interface{}
+	cost  int64      // cost of the item in cost mode, else 0
+	extra *itemExtra // nil until an optional feature needs it
 }
 
-// Cache is an LRU cache.  It is not safe for concurrent access.
+// itemExtra holds the per-item state of the optional features.  It is only
+// allocated for an item given a TTL, read by a cache counting accesses or
+// created WithPromoteThreshold, or promoted in a cache keeping stats, so
+// that a cache using none of them pays a single nil pointer per item.
+type itemExtra struct {
+	expires time.Time     // zero if the item never expires
+	ttl     time.Duration // TTL the item was set with, for WithSlidingTTL
+	hits    int           // Gets since insertion, if counting WithAccessCounts
+	times   *accessRing   // last reads, if recording WithAccessTimes
+	refs    int           // GetRef callers yet to release the item
+
+	level     int // segment levelHits were counted in
+	levelHits int // accesses toward WithPromoteThreshold
+
+	peak int // highest segment reached, if keeping stats
+
+	seq uint64 // insertion sequence number, if WithFIFOAdmission
+}
+
+// ext returns the item's extra state, allocating it if needed
+func (item *cacheItem) ext() *itemExtra {
+	if item.extra == nil {
+		item.extra = &itemExtra{}
+	}
+	return item.extra
+}
+
+// referenced reports whether a GetRef caller has yet to release the item
+func (item *cacheItem) referenced() bool {
+	return item.extra != nil && item.extra.refs > 0
+}
+
+// seq returns the item's insertion sequence number, 0 if it has none
+func (item *cacheItem) seq() uint64 {
+	if item.extra == nil {
+		return 0
+	}
+	return item.extra.seq
+}
+
+// clearTTL makes the item never expire
+func (item *cacheItem) clearTTL() {
+	if item.extra != nil {
+		item.extra.expires = time.Time{}
+		item.extra.ttl = 0
+	}
+}
+
+// Errors returned by GetE
+var (
+	ErrNotFound = errors.New("s4lru: key not found")
+	ErrExpired  = errors.New("s4lru: key expired")
+)
+
+// Cache is an LRU cache.  It is not safe for concurrent access.  Any string,
+// including the empty string, is a valid key.
 type Cache struct {
-	capacity int
-	data     map[string]*list.Element
-	lists    []*list.List
+	// Now returns the current time, used to expire items stored with
+	// SetWithTTL.  If nil, time.Now is used.
+	Now func() time.Time
+
+	// Loader, if set, is called by GetE to fetch the value for a key that
+	// is missing or expired.  Loaded values are stored in the cache.
+	Loader func(key string) (interface{}, error)
+
+	// Logger, if set, is called for each insert, eviction, promotion,
+	// demotion and swap, as a debugging aid for following the cache's
+	// decisions on a real workload.
+	Logger func(format string, args ...interface{})
+
+	// OnInsert, if set, is called with each key newly stored in the cache,
+	// whether by one of the Sets, Restore or WarmHot, but not when the
+	// value of a key already present is replaced.  Together with OnEvict
+	// and OnRemove, it lets a caller mirror the cache's membership, for
+	// example in a secondary index; only items dropped on expiry, and
+	// those Restore discards, leave without a call.  It must not modify
+	// the cache.
+	OnInsert func(key string, value interface{})
+
+	// OnEvict, if set, is called with each item the cache drops to make
+	// room for others or discards in bulk.  It must not modify the cache.
+	OnEvict func(key string, value interface{})
+
+	// BeforeSetEvict, if set, is asked by Set before it evicts an item
+	// from a full segment 0 to make room for a new key.  Returning false
+	// protects that item, and the next coldest is offered instead; if
+	// every item in segment 0 is protected, the Set is dropped.  It isn't
+	// consulted for items evicted as others cascade down from the upper
+	// segments, or in batches WithEvictionBatch.  It must not modify the
+	// cache.
+	BeforeSetEvict func(key string, value interface{}) bool
+
+	// SegmentOnInsert, if set, chooses the segment a new key enters when
+	// stored by Set or SetKeepSegment, instead of segment 0.  Results out
+	// of range are clamped to the lowest or highest segment, and items
+	// displaced from full segments cascade down as for SetWithSegment.  A
+	// key readmitted WithGhost enters no lower than segment 1.  It must not
+	// modify the cache.
+	SegmentOnInsert func(key string, value interface{}) int
+
+	// OnRemove, if set, is called with each item deleted by Remove or
+	// RemoveMulti.  It must not modify the cache.
+	OnRemove func(key string, value interface{})
+
+	adapt *adaptive // nil unless created WithAdaptive
+
+	backfillOnRemove bool
+
+	ghost *ghostList // nil unless created WithGhost
+
+	recent *opRing // nil unless created WithRecentOps
+
+	bypassBelow uint64 // Gets of keys hashing below this miss, see WithBypassRate
+
+	departed *ghostList // keys that left recently, nil unless WithDistinctKeys
+	distinct uint64     // distinct keys inserted, see DistinctKeysSeen
+
+	countAccess bool
+	slidingTTL  bool
+
+	noPromoteOnSet bool // set by WithPromoteOnSet(false)
+
+	order Order // of segment 0, see WithAdmissionOrder
+
+	fifoAdmission bool   // see WithFIFOAdmission
+	insertSeq     uint64 // last insertion sequence number given out
+
+	unbounded bool // see SetUnbounded
+
+	minAdmission int // floor on segment 0's capacity, see WithMinAdmission
+
+	evictions      uint64     // items evicted, whether or not stats are kept
+	lastSetEvicted bool       // see LastSetEvicted
+	evictCh        chan Entry // see WithEvictionChan
+	evictDrops     uint64     // evictions dropped from a full evictCh, atomic
+	collect        *[]Entry   // evictions gathered by SetBatch
+	setCost        int64      // cost given WithCost to the Set in progress
+
+	softLimit   int           // total items Set may grow the cache to, 0 if unset
+	accessTimes int           // ring size for WithAccessTimes, 0 if disabled
+	defaultTTL  time.Duration // TTL Set applies, 0 unless created NewWithTTL
+	evictBatch  int           // items a full segment 0 evicts at once, 0 or 1 for one
+
+	maxKeyLen    int  // longest key stored in bytes, 0 for no limit
+	truncateKeys bool // whether longer keys are truncated, not rejected
+	foldKeys     bool // see WithFoldKeys
+
+	promoteThreshold int // accesses per segment an item needs to climb
+
+	victim     VictimSelector // nil unless created WithVictimSelector
+	victimKeys []string       // reused by selectVictim
+
+	costFn   func(key string, value interface{}) int64 // nil unless created NewWithCost
+	costCaps []int64                                   // per-segment cost budget in cost mode
+
+	countStats  bool
+	stats       counters
+	transitions []uint64 // hits by segment before and after, see TransitionMatrix
+	window      evictionWindow
+
+	inUse      int     // items with outstanding GetRef references
+	walking    int     // number of ForEach calls in progress
+	tombstones []int32 // items removed during ForEach, still linked
+
+	caps  []int            // per-segment capacity
+	data  map[string]int32 // key to item index; nil if created WithMap
+	m     Map              // the replacement for data, if created WithMap
+	items []cacheItem      // items[0] is unused, see list.go
+	free  int32            // head of the list of unused items
+	lists []itemList
 }
 
 // New returns a new S4LRU cache that with the given capacity.  Each of the
-// lists will have 1/4 of the capacity.  New will panic if the capacity is not
-// evenly divisible by 4.
-func New(capacity int) *Cache {
-	if capacity%4 != 0 {
-		panic("s4lru: capacity not evenly divisible by 4")
+// lists will have 1/4 of the capacity; if the capacity is not evenly divisible
+// by 4, the remaining slots go to the lowest lists.  New will panic if the
+// capacity is negative.
+//
+// A cache with a capacity of less than 4 can't give every list a slot, so it
+// is built with a single list and behaves as a plain LRU cache holding
+// capacity items.
+//
+// The cache's internal storage is sized for capacity items up front, so
+// that filling it doesn't rehash or copy; see NewWithHint to size it for
+// fewer.
+func New(capacity int, opts ...Option) *Cache {
+	return NewWithHint(capacity, capacity, opts...)
+}
+
+// NewWithHint is like New, but sizes the cache's internal storage for
+// expectedItems items rather than capacity, for a cache with a large
+// capacity that is expected never to fill.  The hint only affects
+// allocation; the cache still grows to capacity if needed.  expectedItems is
+// clamped to the range 0 to capacity.
+func NewWithHint(capacity, expectedItems int, opts ...Option) *Cache {
+	if capacity < 0 {
+		panic("s4lru: negative capacity")
+	}
+	segments := 4
+	if capacity < segments {
+		segments = 1
+	}
+	if expectedItems < 0 {
+		expectedItems = 0
+	}
+	if expectedItems > capacity {
+		expectedItems = capacity
+	}
+	c := &Cache{
+		caps:  splitCapacity(capacity, segments),
+		data:  make(map[string]int32, expectedItems),
+		items: make([]cacheItem, 1, expectedItems+1),
+		lists: make([]itemList, segments),
+	}
+	c.apply(opts)
+	return c
+}
+
+// NewWithTTL returns a new S4LRU cache with the given capacity, as for New,
+// in which every value stored by Set, SetKeepSegment or SetWithSegment
+// expires after defaultTTL.  SetWithTTL overrides the default for a single
+// value.  Expired items are removed lazily, when they are next looked up.
+// NewWithTTL will panic if defaultTTL is not positive.
+func NewWithTTL(capacity int, defaultTTL time.Duration, opts ...Option) *Cache {
+	if defaultTTL <= 0 {
+		panic("s4lru: default TTL must be positive")
+	}
+	c := New(capacity, opts...)
+	c.defaultTTL = defaultTTL
+	return c
+}
+
+// NewFromMap returns a new S4LRU cache with the given capacity, as for New,
+// seeded with the contents of data as WarmHot places them: the top segment
+// is filled first, then the one below it, down to segment 0, so a map that
+// fits is stored whole.  If data holds more keys than fit, the excess is
+// dropped, and as map iteration order is random, which keys survive and
+// which segments they land in varies from run to run; use NewFromEntries
+// for deterministic seeding.
+func NewFromMap(capacity int, data map[string]interface{}, opts ...Option) *Cache {
+	c := New(capacity, opts...)
+	entries := make([]Entry, 0, len(data))
+	for key, value := range data {
+		entries = append(entries, Entry{Key: key, Value: value})
+	}
+	c.WarmHot(entries)
+	return c
+}
+
+// NewFromEntries returns a new S4LRU cache with the given capacity, as for
+// New, holding entries as Restore places them: in slice order, which is
+// taken to be hottest-first as Snapshot returns it, each at the back of its
+// Segment or the next lower segment with room.  Entries that fit nowhere,
+// the coldest, are dropped, so the result depends only on the slice, and
+// seeding from a Snapshot of a cache with the same capacity and options
+// reproduces it.
+func NewFromEntries(capacity int, entries []Entry, opts ...Option) *Cache {
+	c := New(capacity, opts...)
+	c.Restore(entries)
+	return c
+}
+
+// NewWithSegments returns a new S4LRU-style cache with one segment per entry
+// in caps, holding up to caps[i] items in segment i.  Segment 0 is the
+// admission segment.  Segments may be given a capacity of 0, in which case
+// items are never promoted past the segment below them.  NewWithSegments will
+// panic if caps is empty or contains a negative capacity.
+func NewWithSegments(caps []int, opts ...Option) *Cache {
+	if len(caps) == 0 {
+		panic("s4lru: no segments")
+	}
+	total := 0
+	for _, n := range caps {
+		if n < 0 {
+			panic("s4lru: negative segment capacity")
+		}
+		total += n
+	}
+	c := &Cache{
+		caps:  append([]int(nil), caps...),
+		data:  make(map[string]int32, total),
+		items: make([]cacheItem, 1, total+1),
+		lists: make([]itemList, len(caps)),
+	}
+	c.apply(opts)
+	return c
+}
+
+// ErrNoCapacity is returned by NewE and NewWithSegmentsE for a cache that
+// could never hold an item, and wrapped by TrySet for a cache that can't
+// admit one
+var ErrNoCapacity = errors.New("s4lru: cache has no capacity")
+
+// NewE is like New, but returns an error instead of panicking for a negative
+// capacity, and rejects a capacity of 0 with ErrNoCapacity.  The minimum
+// capacity is 1.
+func NewE(capacity int, opts ...Option) (*Cache, error) {
+	if capacity < 0 {
+		return nil, errors.New("s4lru: negative capacity")
+	}
+	if capacity == 0 {
+		return nil, ErrNoCapacity
 	}
-	return &Cache{
-		capacity: capacity / 4,
-		data:     make(map[string]*list.Element),
-		lists:    []*list.List{list.New(), list.New(), list.New(), list.New()},
+	return New(capacity, opts...), nil
+}
+
+// NewWithSegmentsE is like NewWithSegments, but returns an error instead of
+// panicking for invalid caps.  It also rejects caps whose total is 0 with
+// ErrNoCapacity, and caps that give segment 0 no capacity, since Set could
+// never admit an item to such a cache.
+func NewWithSegmentsE(caps []int, opts ...Option) (*Cache, error) {
+	if len(caps) == 0 {
+		return nil, errors.New("s4lru: no segments")
+	}
+	total := 0
+	for _, n := range caps {
+		if n < 0 {
+			return nil, errors.New("s4lru: negative segment capacity")
+		}
+		total += n
+	}
+	if total == 0 {
+		return nil, ErrNoCapacity
+	}
+	if caps[0] == 0 {
+		return nil, errors.New("s4lru: segment 0 has no capacity")
+	}
+	return NewWithSegments(caps, opts...), nil
+}
+
+// raiseAdmission moves capacity into segment 0 from the largest upper
+// segments until it meets the floor set by WithMinAdmission.  It is only called
+// while the caps are being laid out, before any items are placed.
+func (c *Cache) raiseAdmission() {
+	for c.caps[0] < c.minAdmission {
+		from := 0
+		for seg := len(c.caps) - 1; seg > 0; seg-- {
+			if c.caps[seg] > c.caps[from] || from == 0 && c.caps[seg] > 0 {
+				from = seg
+			}
+		}
+		if from == 0 {
+			return // everything is in segment 0 already
+		}
+		c.caps[from]--
+		c.caps[0]++
 	}
 }
 
+// scaleCapacity returns caps scaled to total capacity, in proportion; the
+// slots lost to rounding go to the segments with the largest remainders,
+// the lowest first among equals
+func scaleCapacity(caps []int, capacity int) []int {
+	total := 0
+	for _, n := range caps {
+		total += n
+	}
+	if total == 0 {
+		return splitCapacity(capacity, len(caps))
+	}
+
+	scaled := make([]int, len(caps))
+	rem := make([]int, len(caps))
+	left := capacity
+	for i, n := range caps {
+		scaled[i] = n * capacity / total
+		rem[i] = n * capacity % total
+		left -= scaled[i]
+	}
+	for ; left > 0; left-- {
+		best := 0
+		for i := range rem {
+			if rem[i] > rem[best] {
+				best = i
+			}
+		}
+		scaled[best]++
+		rem[best] = -1
+	}
+	return scaled
+}
+
+// splitCapacity divides capacity as evenly as possible between n segments,
+// giving any remainder to the lowest segments
+func splitCapacity(capacity, n int) []int {
+	caps := make([]int, n)
+	for i := range caps {
+		caps[i] = capacity / n
+		if i < capacity%n {
+			caps[i]++
+		}
+	}
+	return caps
+}
+
 // Get returns a value from the cache
 func (c *Cache) Get(key string) (interface{}, bool) {
-	v, ok := c.data[key]
+	i, ok := c.lookup(key)
+	if !ok {
+		return nil, false
+	}
 
+	value := c.items[i].value
+	c.hit(i)
+	return value, true
+}
+
+// GetOrDefault returns the value stored under key, promoting it as Get does,
+// or def if key isn't present.  def is not stored.
+func (c *Cache) GetOrDefault(key string, def interface{}) interface{} {
+	if v, ok := c.Get(key); ok {
+		return v
+	}
+	return def
+}
+
+// GetAndModify looks up key, promoting it as Get does, and replaces its
+// value with fn's result, for mutable aggregates such as counters that are
+// updated in place rather than read and stored again with Set.  The item
+// keeps its position and any TTL, and in cost mode is recosted, and removed
+// if the new value is too big to fit.  It returns the new value, or false
+// without calling fn if key isn't present.  fn must not use the cache.
+func (c *Cache) GetAndModify(key string, fn func(value interface{}) interface{}) (interface{}, bool) {
+	i, ok := c.lookup(key)
 	if !ok {
 		return nil, false
 	}
 
-	item := v.Value.(*cacheItem)
+	c.hit(i)
+	item := &c.items[i]
+	item.value = fn(item.value)
+	value := item.value
+	c.recost(i)
+	if c.tooBig(item.cost) {
+		c.Remove(item.key)
+	} else if c.costFn != nil {
+		c.cascade(item.lidx)
+	}
+	return value, true
+}
+
+// hit promotes item i after a successful lookup by Get, and drives the
+// adaptive sizing
+func (c *Cache) hit(i int32) {
+	if c.adapt != nil {
+		c.adapt.hit(c.items[i].lidx)
+	}
+
+	from := c.items[i].lidx
+	c.climb(i)
+	if c.countStats {
+		c.transition(from, c.items[i].lidx)
+	}
+
+	if c.adapt != nil && c.adapt.due() {
+		c.rebalance()
+	}
+}
+
+// climb promotes item i for an access by Get, TouchMulti or Set, once it
+// has had as many accesses in its segment as WithPromoteThreshold requires;
+// until then the access only moves it to the front of its segment
+func (c *Cache) climb(i int32) {
+	if c.promoteThreshold > 1 {
+		item := &c.items[i]
+		x := item.ext()
+		if x.level != item.lidx {
+			x.level, x.levelHits = item.lidx, 0
+		}
+		if x.levelHits++; x.levelHits < c.promoteThreshold {
+			c.touch(i)
+			return
+		}
+		c.promote(i)
+		x.level, x.levelHits = item.lidx, 0
+		return
+	}
+	c.promote(i)
+}
+
+// GetRef returns a value from the cache like Get, along with a func to call
+// once the caller is done with it, for values that are pooled or reference
+// counted.  Until every GetRef of an item has been released, the item isn't
+// evicted to make room for others: the next coldest item goes instead, and
+// if all of segment 0 is in use, a new key is rejected by Set, and a segment
+// 0 overfilled by items demoted into it stays over capacity.  An item in use
+// can still be updated, removed, or expire.  Calling release more than once,
+// or after the item has left the cache, does nothing.
+//
+// Every reference that is never released pins its item for as long as it
+// stays in the cache; enough leaked references will leave no room for new
+// keys.
+func (c *Cache) GetRef(key string) (value interface{}, release func(), ok bool) {
+	i, ok := c.lookup(key)
+	if !ok {
+		return nil, nil, false
+	}
+
+	value = c.items[i].value
+	release = c.ref(i)
+	c.hit(i)
+	return value, release, true
+}
+
+// ref takes a reference to item i, returning the func that releases it
+func (c *Cache) ref(i int32) func() {
+	x := c.items[i].ext()
+	if x.refs == 0 {
+		c.inUse++
+	}
+	x.refs++
+
+	released := false
+	return func() {
+		if released || x.refs == 0 {
+			return
+		}
+		released = true
+		if x.refs--; x.refs == 0 {
+			c.inUse--
+		}
+	}
+}
+
+// GetNoPromote returns a value from the cache without changing its position,
+// for speculative reads such as prefetching that shouldn't affect which items
+// the cache keeps.  Unlike Peek, it is otherwise treated as a real read: it is
+// counted in Stats and access counts, and removes an expired item.
+func (c *Cache) GetNoPromote(key string) (interface{}, bool) {
+	i, ok := c.lookup(key)
+	if !ok {
+		return nil, false
+	}
+	return c.items[i].value, true
+}
+
+// TouchMulti promotes each of keys that is present one segment, as a Get
+// would, without returning the values or counting reads in Stats.  It
+// returns the number of keys found.
+func (c *Cache) TouchMulti(keys []string) int {
+	n := 0
+	for _, key := range keys {
+		if i, ok := c.get(key); ok && !c.expired(&c.items[i]) {
+			c.climb(i)
+			n++
+		}
+	}
+	return n
+}
+
+// lookup finds the live item for key on behalf of a read, removing it if it
+// has expired, and counts the read
+func (c *Cache) lookup(key string) (int32, bool) {
+	i, err := c.lookupE(key)
+	return i, err == nil
+}
+
+// lookupE is lookup, reporting why it missed: ErrExpired if key was present
+// but has expired, else ErrNotFound, including for a bypassed key or one
+// drained under the soft limit
+func (c *Cache) lookupE(key string) (int32, error) {
+	c.window.op()
+	c.record(OpGet, key)
+
+	if c.bypassBelow > 0 && uint64(fnv1a(key)) < c.bypassBelow {
+		c.stats.miss(c.countStats)
+		return 0, ErrNotFound
+	}
+
+	if c.softLimit > 0 {
+		c.drain()
+	}
+
+	i, ok := c.get(key)
+
+	if !ok {
+		c.stats.miss(c.countStats)
+		return 0, ErrNotFound
+	}
+
+	item := &c.items[i]
+
+	if c.expired(item) {
+		if c.Logger != nil {
+			c.Logger("expire %q segment=%d", key, item.lidx)
+		}
+		if c.departed != nil {
+			c.departed.add(item.key)
+		}
+		c.unlink(i)
+		c.delStored(item.key)
+		c.release(i)
+		c.stats.miss(c.countStats)
+		return 0, ErrExpired
+	}
+
+	c.stats.hit(c.countStats)
+
+	if c.slidingTTL && item.extra != nil && item.extra.ttl > 0 {
+		item.extra.expires = c.now().Add(item.extra.ttl)
+	}
+
+	if c.countAccess {
+		item.ext().hits++
+	}
+
+	if c.accessTimes > 0 {
+		x := item.ext()
+		if x.times == nil {
+			x.times = &accessRing{t: make([]time.Time, 0, c.accessTimes)}
+		}
+		x.times.add(c.now())
+	}
+
+	return i, nil
+}
+
+// touch moves item i to the front of its segment after a hit that can't
+// promote it, unless it is in a FIFO segment 0
+func (c *Cache) touch(i int32) {
+	if c.items[i].lidx == 0 && c.order == FIFO {
+		return
+	}
+	c.moveToFront(i)
+}
+
+// promote moves item i up one segment after a hit
+func (c *Cache) promote(i int32) {
+	item := &c.items[i]
 
 	// already on final list?
 	if item.lidx == len(c.lists)-1 {
-		c.lists[item.lidx].MoveToFront(v)
-		return item.value, true
+		c.touch(i)
+		return
 	}
 
 	// is there space on the next list?
-	if c.lists[item.lidx+1].Len() < c.capacity {
+	if c.fits(item.lidx+1, item.cost) {
 		// just do the remove/add
-		c.lists[item.lidx].Remove(v)
-		item.lidx++
-		c.data[key] = c.lists[item.lidx].PushFront(item)
-		return item.value, true
+		if c.Logger != nil {
+			c.Logger("promote %q segment=%d->%d", item.key, item.lidx, item.lidx+1)
+		}
+		seg := item.lidx + 1
+		c.unlink(i)
+		c.link(seg, i)
+		if c.countStats {
+			atomic.AddUint64(&c.stats.moves, 1)
+		}
+		return
 	}
 
-	// no free space on either list, so we do some in-place swapping to avoid allocations
-	// the key/value in bitem need to be moved to the front of c.lists[item.lidx]
-	// the key/value in item need to be moved to the front of c.lists[bitem.lidx]
-	back := c.lists[item.lidx+1].Back()
-	bitem := back.Value.(*cacheItem)
+	if c.costFn != nil {
+		// items differ in cost, so a swap could overfill either list:
+		// move item up if it can fit at all, demoting what it displaces
+		seg := item.lidx + 1
+		if item.cost > c.costCaps[seg] {
+			c.touch(i)
+			return
+		}
+		if c.Logger != nil {
+			c.Logger("promote %q segment=%d->%d", item.key, item.lidx, seg)
+		}
+		c.unlink(i)
+		c.link(seg, i)
+		c.cascade(seg)
+		if c.countStats {
+			atomic.AddUint64(&c.stats.moves, 1)
+		}
+		return
+	}
 
-	// swap the key/values
-	bitem.key, item.key = item.key, bitem.key
-	bitem.value, item.value = item.value, bitem.value
+	// no free space on either list, so item and the tail of the next list,
+	// b, trade places: item moves to the front of the next list, b to the
+	// front of item's list.  This only relinks the existing items and never
+	// allocates, which TestPromoteAllocs enforces.
+	b := c.lists[item.lidx+1].tail
+	if b == 0 {
+		// the next list has no capacity at all, so there is nowhere to
+		// promote to: treat this as a hit on the current list
+		c.touch(i)
+		return
+	}
 
-	// update pointers in the map
-	c.data[item.key] = v
-	c.data[bitem.key] = back
+	if c.Logger != nil {
+		c.Logger("swap %q segment=%d->%d with %q segment=%d->%d", item.key, item.lidx, item.lidx+1, c.items[b].key, item.lidx+1, item.lidx)
+	}
 
-	// move the elements to the front of their lists
-	c.lists[item.lidx].MoveToFront(v)
-	c.lists[bitem.lidx].MoveToFront(back)
+	seg := item.lidx
+	c.unlink(i)
+	c.unlink(b)
+	c.link(seg+1, i)
+	c.link(seg, b)
+	c.lists[seg+1].evictions++
+	if c.countStats {
+		atomic.AddUint64(&c.stats.swaps, 1)
+	}
+}
 
-	return bitem.value, true
+// Peek returns a value from the cache without promoting it or counting the
+// lookup in Stats.  An expired item is reported as missing but left for Get
+// to remove.
+func (c *Cache) Peek(key string) (interface{}, bool) {
+	i, ok := c.get(key)
+	if !ok || c.expired(&c.items[i]) {
+		return nil, false
+	}
+	return c.items[i].value, true
 }
 
-// Set sets a value in the cache
-func (c *Cache) Set(key string, value interface{}) {
-	if c.lists[0].Len() < c.capacity {
-		c.data[key] = c.lists[0].PushFront(&cacheItem{0, key, value})
+// Contains reports whether key is in the cache, without promoting it or
+// counting the lookup in Stats.  Like Peek, it reports an expired item as
+// missing.
+func (c *Cache) Contains(key string) bool {
+	_, ok := c.Peek(key)
+	return ok
+}
+
+// GetTrace performs a Get for each of keys in turn and returns, for each one,
+// the segment the key occupies after its Get, or -1 for a miss.  It is
+// intended for replaying traces when studying the algorithm.
+func (c *Cache) GetTrace(keys []string) []int {
+	trace := make([]int, len(keys))
+	for i, key := range keys {
+		trace[i] = -1
+		if _, ok := c.Get(key); ok {
+			trace[i] = c.items[c.slot(key)].lidx
+		}
+	}
+	return trace
+}
+
+// GetTransition returns a value from the cache like Get, along with the
+// segment the item was in before the Get and the one it occupies after it.
+// When a promotion swaps the item with the tail of a full segment, to is the
+// segment it was swapped into.  On a miss, from and to are -1.
+func (c *Cache) GetTransition(key string) (value interface{}, from, to int, ok bool) {
+	from, to = -1, -1
+	if i, found := c.get(key); found {
+		from = c.items[i].lidx
+	}
+	value, ok = c.Get(key)
+	if !ok {
+		return nil, -1, -1, false
+	}
+	if i, found := c.get(key); found {
+		// a rebalance triggered by the Get could have evicted it
+		to = c.items[i].lidx
+	}
+	return value, from, to, true
+}
+
+// Set sets a value in the cache.  Setting a key that is already present
+// replaces its value, clears any TTL, and by default counts as an access,
+// promoting it as Get does; see WithPromoteOnSet.  For a cache created
+// NewWithTTL, the value expires after the default TTL.  opts adjust how the
+// value is stored; see SetOption.
+func (c *Cache) Set(key string, value interface{}, opts ...SetOption) {
+	if len(opts) > 0 {
+		c.setWith(key, value, opts)
+		return
+	}
+	n := c.evictions
+	c.set(key, value)
+	c.lastSetEvicted = c.evictions != n
+	if c.defaultTTL > 0 {
+		c.expireAfter(key, c.defaultTTL)
+	}
+}
+
+func (c *Cache) set(key string, value interface{}) {
+	c.record(OpSet, key)
+	key, ok := c.storeKey(key)
+	if !ok {
+		return
+	}
+
+	c.window.op()
+
+	if i, ok := c.get(key); ok {
+		if c.Logger != nil {
+			c.Logger("update %q segment=%d", key, c.items[i].lidx)
+		}
+		c.items[i].value = value
+		c.items[i].clearTTL()
+		c.recost(i)
+		if c.tooBig(c.items[i].cost) {
+			c.Remove(key)
+			return
+		}
+		if !c.noPromoteOnSet {
+			c.climb(i)
+		}
+		if c.costFn != nil {
+			c.cascade(c.items[i].lidx)
+		}
+		return
+	}
+
+	seg := c.insertSegment(key, value)
+	if c.ghost != nil && c.ghost.contains(key) && len(c.lists) > 1 {
+		// evicted recently and wanted again: skip the admission segment
+		c.ghost.remove(key)
+		if seg < 1 {
+			seg = 1
+		}
+	}
+
+	if seg > 0 || c.costFn != nil {
+		c.insertAt(key, value, seg)
+		return
+	}
+
+	if c.evictBatch > 1 && !c.fits(0, 0) {
+		// make room for this insert and the next few at once
+		c.trim(c.lowWatermark())
+	}
+
+	if c.fits(0, 0) {
+		if c.Logger != nil {
+			c.Logger("insert %q segment=0", key)
+		}
+		i := c.alloc()
+		c.items[i].key = key
+		c.items[i].value = value
+		c.put(key, i)
+		c.inserted(i)
+		c.admit(i)
+		return
+	}
+
+	// reuse the tail item, or the victim's
+	i := c.lists[0].tail
+	if i == 0 {
+		// segment 0 has no capacity, nothing can be stored
 		return
 	}
+	if c.victim != nil || c.fifoAdmission {
+		i = c.victim0()
+	}
+	if c.inUse > 0 {
+		if i = c.coldestFree(i); i == 0 {
+			if c.Logger != nil {
+				c.Logger("reject %q segment=0", key)
+			}
+			return
+		}
+	}
+	if c.BeforeSetEvict != nil {
+		if i = c.setVictim(i); i == 0 {
+			if c.Logger != nil {
+				c.Logger("reject %q segment=0", key)
+			}
+			return
+		}
+	}
+	item := &c.items[i]
 
-	// reuse the tail item
-	e := c.lists[0].Back()
-	item := e.Value.(*cacheItem)
+	c.evicted(i, 0)
+	if c.Logger != nil {
+		c.Logger("insert %q segment=0", key)
+	}
 
-	delete(c.data, item.key)
+	c.delStored(item.key)
 	item.key = key
 	item.value = value
-	c.data[key] = e
-	c.lists[0].MoveToFront(e)
+	item.extra = nil
+	c.put(key, i)
+	c.inserted(i)
+	c.unlink(i)
+	c.admit(i)
 }
 
-// Len returns the total number of items in the cache
+// admit links the new item i into segment 0, at the front, or at the back
+// if it is LIFO
+func (c *Cache) admit(i int32) {
+	if c.order == LIFO {
+		c.linkBack(0, i)
+		return
+	}
+	c.link(0, i)
+}
+
+// LastSetEvicted reports whether the most recent Set, SetWithTTL,
+// SetKeepSegment or SetWithSegment evicted anything to make room, as cheap
+// backpressure for a caller that doesn't want an OnEvict callback.  Other
+// operations leave it unchanged.  It is only meaningful when one goroutine
+// uses the cache: for a SyncCache, the most recent Set may be another
+// goroutine's.
+func (c *Cache) LastSetEvicted() bool {
+	return c.lastSetEvicted
+}
+
+// insertSegment returns the segment a new key enters, as chosen by
+// SegmentOnInsert and clamped to the valid range, or 0
+func (c *Cache) insertSegment(key string, value interface{}) int {
+	if c.SegmentOnInsert == nil {
+		return 0
+	}
+	seg := c.SegmentOnInsert(key, value)
+	if seg < 0 {
+		return 0
+	}
+	if seg >= len(c.lists) {
+		return len(c.lists) - 1
+	}
+	return seg
+}
+
+// TrySet sets a value in the cache as Set does, but returns an error instead
+// of silently dropping the value: ErrKeyTooLong for a key rejected by
+// WithMaxKeyLen, or one wrapping ErrNoCapacity for a new key that the cache
+// has no room to admit because segment 0 has no capacity, as happens for a
+// cache created with a capacity of 0.  Updates of keys already present
+// otherwise always succeed.
+func (c *Cache) TrySet(key string, value interface{}) error {
+	if _, ok := c.storeKey(key); !ok {
+		return ErrKeyTooLong
+	}
+	if _, ok := c.get(key); !ok && c.admitsNothing() {
+		return fmt.Errorf("s4lru: storing %q: %w", key, ErrNoCapacity)
+	}
+	c.Set(key, value)
+	return nil
+}
+
+// admitsNothing reports whether segment 0 can never hold an item
+func (c *Cache) admitsNothing() bool {
+	if c.costFn != nil {
+		return c.costCaps[0] == 0
+	}
+	return c.caps[0]+c.excess(0) == 0
+}
+
+// WouldAdmit reports whether a Set of key now would store it, without
+// changing anything, so a caller can skip computing a value the cache would
+// only drop.  A key already present is always updated.  A new key is
+// rejected if WithMaxKeyLen refuses it, if segment 0 has no capacity, or if
+// segment 0 is full and every item in it is held by GetRef or protected by
+// BeforeSetEvict, which is consulted as Set would; but a key still in the
+// WithGhost list enters segment 1 and is admitted regardless.  SegmentOnInsert
+// isn't consulted, as it depends on the value, and in cost mode neither is
+// the value's cost, so WouldAdmit reports true for any key there as long as
+// segment 0 has some capacity.
+func (c *Cache) WouldAdmit(key string) bool {
+	key, ok := c.storeKey(key)
+	if !ok {
+		return false
+	}
+	if _, ok := c.get(key); ok {
+		return true
+	}
+	if c.admitsNothing() {
+		return false
+	}
+	if c.ghost != nil && c.ghost.contains(key) && len(c.lists) > 1 {
+		return true
+	}
+	if c.costFn != nil || c.fits(0, 0) {
+		return true
+	}
+
+	i := c.lists[0].tail
+	if c.victim != nil || c.fifoAdmission {
+		i = c.victim0()
+	}
+	if c.inUse > 0 {
+		if i = c.coldestFree(i); i == 0 {
+			return false
+		}
+	}
+	if c.BeforeSetEvict != nil {
+		return c.setVictim(i) != 0
+	}
+	return true
+}
+
+// setVictim returns the item Set should evict, i unless BeforeSetEvict
+// protects it, else the coldest item in segment 0 it doesn't, or 0 if it
+// protects them all
+func (c *Cache) setVictim(i int32) int32 {
+	if c.BeforeSetEvict(c.items[i].key, c.items[i].value) {
+		return i
+	}
+	for j := c.lists[0].tail; j != 0; j = c.items[j].prev {
+		if j != i && !c.items[j].referenced() && c.BeforeSetEvict(c.items[j].key, c.items[j].value) {
+			return j
+		}
+	}
+	return 0
+}
+
+// coldestFree returns i, an item in segment 0 chosen for eviction, unless it
+// is referenced by GetRef, in which case it returns the coldest item that
+// isn't, or 0 if all of them are
+func (c *Cache) coldestFree(i int32) int32 {
+	if c.inUse == 0 || !c.items[i].referenced() {
+		return i
+	}
+	for j := c.lists[0].tail; j != 0; j = c.items[j].prev {
+		if !c.items[j].referenced() {
+			return j
+		}
+	}
+	return 0
+}
+
+// SetKeepSegment sets a value in the cache without moving an existing item:
+// its value is replaced and any TTL cleared, as for Set, but it keeps its
+// segment and its position within it.  A key that isn't present is inserted
+// at the front of segment 0.  Like Set, it applies the default TTL of a
+// cache created NewWithTTL.
+func (c *Cache) SetKeepSegment(key string, value interface{}) {
+	n := c.evictions
+	c.setKeepSegment(key, value)
+	c.lastSetEvicted = c.evictions != n
+	if c.defaultTTL > 0 {
+		c.expireAfter(key, c.defaultTTL)
+	}
+}
+
+func (c *Cache) setKeepSegment(key string, value interface{}) {
+	c.record(OpSet, key)
+	key, ok := c.storeKey(key)
+	if !ok {
+		return
+	}
+
+	c.window.op()
+
+	i, ok := c.get(key)
+	if !ok {
+		c.insertAt(key, value, c.insertSegment(key, value))
+		return
+	}
+
+	if c.Logger != nil {
+		c.Logger("update %q segment=%d", key, c.items[i].lidx)
+	}
+	c.items[i].value = value
+	c.items[i].clearTTL()
+	c.recost(i)
+	if c.tooBig(c.items[i].cost) {
+		c.Remove(key)
+		return
+	}
+	if c.costFn != nil {
+		c.cascade(c.items[i].lidx)
+	}
+}
+
+// victim0 returns the item a full segment 0 evicts: the one the
+// VictimSelector chooses, else the oldest inserted for a cache created
+// WithFIFOAdmission, else the tail
+func (c *Cache) victim0() int32 {
+	if c.victim != nil {
+		return c.selectVictim()
+	}
+	if !c.fifoAdmission {
+		return c.lists[0].tail
+	}
+	oldest := c.lists[0].tail
+	for i := oldest; i != 0; i = c.items[i].prev {
+		if c.items[i].seq() < c.items[oldest].seq() {
+			oldest = i
+		}
+	}
+	return oldest
+}
+
+// selectVictim asks the VictimSelector which item of the full segment 0 to
+// evict, falling back to the tail if it names a key that isn't there.  The
+// keys are gathered into a buffer kept on the cache, so that choosing a
+// victim doesn't allocate once the buffer has grown to segment 0's size.
+func (c *Cache) selectVictim() int32 {
+	keys := c.victimKeys[:0]
+	for i := c.lists[0].tail; i != 0; i = c.items[i].prev {
+		keys = append(keys, c.items[i].key)
+	}
+	victim := c.victim(keys)
+	for j := range keys {
+		keys[j] = "" // don't keep evicted keys alive
+	}
+	c.victimKeys = keys
+
+	if i, ok := c.getStored(victim); ok && c.items[i].lidx == 0 {
+		return i
+	}
+	return c.lists[0].tail
+}
+
+// lowWatermark returns the number of items a full segment 0 is emptied down to
+// by a batched eviction
+func (c *Cache) lowWatermark() int {
+	if n := c.caps[0] + c.excess(0) - c.evictBatch; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// trim evicts items from the back of segment 0, or those victim0 chooses,
+// until it holds at most n
+func (c *Cache) trim(n int) {
+	for c.lists[0].Len() > n {
+		b := c.lists[0].tail
+		if c.victim != nil || c.fifoAdmission {
+			b = c.victim0()
+		}
+		if b = c.coldestFree(b); b == 0 {
+			return
+		}
+		c.evict(b)
+	}
+}
+
+// softDrain is the most excess items a single read evicts for a cache
+// created WithSoftLimit
+const softDrain = 2
+
+// excess returns how many items segment seg may hold beyond its capacity
+// under a soft limit.  Every insert, whichever path it takes, may grow
+// segment 0 into the excess; only reads drain it.
+func (c *Cache) excess(seg int) int {
+	if seg != 0 || c.softLimit == 0 || c.softLimit <= c.Capacity() {
+		return 0
+	}
+	return c.softLimit - c.Capacity()
+}
+
+// drain evicts a few of the items segment 0 holds beyond its capacity
+func (c *Cache) drain() {
+	for n := 0; n < softDrain && c.lists[0].Len() > c.caps[0] && !c.unbounded; n++ {
+		b := c.coldestFree(c.lists[0].tail)
+		if b == 0 {
+			return
+		}
+		c.evicted(b, 0)
+		c.unlink(b)
+		c.delStored(c.items[b].key)
+		c.release(b)
+	}
+}
+
+// SetWithSegment sets a value in the cache and places it at the front of
+// segment seg, whether or not the key was already present.  Items displaced
+// from full segments cascade down as for MoveToSegment.  Like Set, it
+// applies the default TTL of a cache created NewWithTTL.  SetWithSegment
+// will panic if seg is out of range.
+func (c *Cache) SetWithSegment(key string, value interface{}, seg int) {
+	if seg < 0 || seg >= len(c.lists) {
+		panic("s4lru: segment out of range")
+	}
+	n := c.evictions
+	c.setWithSegment(key, value, seg)
+	c.lastSetEvicted = c.evictions != n
+	if c.defaultTTL > 0 {
+		c.expireAfter(key, c.defaultTTL)
+	}
+}
+
+func (c *Cache) setWithSegment(key string, value interface{}, seg int) {
+	c.record(OpSet, key)
+	key, ok := c.storeKey(key)
+	if !ok {
+		return
+	}
+
+	c.window.op()
+
+	if i, ok := c.get(key); ok {
+		c.items[i].value = value
+		c.items[i].clearTTL()
+		c.recost(i)
+		if c.tooBig(c.items[i].cost) {
+			c.Remove(key)
+			return
+		}
+		c.MoveToSegment(key, seg)
+		return
+	}
+
+	c.insertAt(key, value, seg)
+}
+
+// insertAt inserts a new key at the front of segment seg, cascading any
+// displaced items downwards.  In cost mode, an item is placed no higher than
+// the highest segment at or below seg that could hold it, and one too costly
+// for any segment is not stored.
+func (c *Cache) insertAt(key string, value interface{}, seg int) {
+	cost := c.costOf(key, value)
+	if c.tooBig(cost) {
+		return
+	}
+	for c.costFn != nil && cost > c.costCaps[seg] {
+		seg--
+	}
+	if seg == 0 && c.victim != nil && !c.fits(0, cost) {
+		// let the selector choose among the items already there, before
+		// the newcomer joins them
+		if b := c.coldestFree(c.selectVictim()); b != 0 {
+			c.evict(b)
+		}
+	}
+	if seg == 0 && c.order == LIFO {
+		// make room first, as the newcomer at the back would otherwise be
+		// the cascade's victim
+		for !c.fits(0, cost) {
+			b := c.coldestFree(c.victim0())
+			if b == 0 {
+				break
+			}
+			c.evict(b)
+		}
+	}
+	if c.Logger != nil {
+		c.Logger("insert %q segment=%d", key, seg)
+	}
+	i := c.alloc()
+	c.items[i].key = key
+	c.items[i].value = value
+	c.items[i].cost = cost
+	c.put(key, i)
+	c.inserted(i)
+	if seg == 0 {
+		c.admit(i)
+	} else {
+		c.link(seg, i)
+	}
+	c.cascade(seg)
+}
+
+// inserted records that item i has just been inserted into the cache
+func (c *Cache) inserted(i int32) {
+	key := c.items[i].key
+	if c.fifoAdmission {
+		c.insertSeq++
+		c.items[i].ext().seq = c.insertSeq
+	}
+	if c.departed != nil {
+		if c.departed.contains(key) {
+			c.departed.remove(key)
+		} else {
+			c.distinct++
+		}
+	}
+	if c.OnInsert != nil {
+		c.OnInsert(key, c.items[i].value)
+	}
+}
+
+// DistinctKeysSeen returns the approximate number of distinct keys stored in
+// the cache since it was created, counted only for caches created
+// WithDistinctKeys
+func (c *Cache) DistinctKeysSeen() uint64 {
+	return c.distinct
+}
+
+// Len returns the total number of items in the cache.  It never exceeds
+// Capacity, except in cost mode, while unbounded, and, for caches created
+// WithSoftLimit, briefly after a burst of inserts.
 func (c *Cache) Len() int {
-	return len(c.data)
+	return c.count()
+}
+
+// AccessCount returns the number of times key has been read by Get since it
+// was inserted, and whether it is present.  Counts survive promotions and
+// demotions, but start again from zero if the key is evicted and inserted
+// again.  Counts are only kept for caches created WithAccessCounts; otherwise
+// the count is always 0.
+func (c *Cache) AccessCount(key string) (int, bool) {
+	i, ok := c.get(key)
+	if !ok {
+		return 0, false
+	}
+	if x := c.items[i].extra; x != nil {
+		return x.hits, true
+	}
+	return 0, true
+}
+
+// Capacity returns the maximum number of items the cache can hold, the sum
+// of the capacities of its segments.  It is 0 for a cache created by
+// NewWithCost, whose segments are limited by cost instead.
+func (c *Cache) Capacity() int {
+	total := 0
+	for _, n := range c.caps {
+		total += n
+	}
+	return total
+}
+
+// entryOverhead estimates the bookkeeping bytes of one item: its slot, and
+// its map entry of a key header, an index and a byte of hash
+const entryOverhead = int64(unsafe.Sizeof(cacheItem{}) + unsafe.Sizeof("") + unsafe.Sizeof(int32(0)) + 1)
+
+// OverheadBytes estimates the memory the cache spends on bookkeeping for the
+// items it holds, for capacity planning: Len times the size of an item's
+// slot and map entry.  It excludes the keys' and values' own bytes, the
+// spare room a Go map keeps, and the per-item state of optional features
+// such as TTLs, so it is a lower bound that grows linearly with Len.
+func (c *Cache) OverheadBytes() int64 {
+	return int64(c.Len()) * entryOverhead
+}
+
+// SetWithTTL sets a value in the cache that expires after ttl.  Expired items
+// are removed lazily, when they are next looked up.  For caches created
+// WithSlidingTTL, every read extends the expiry to ttl from the time of the
+// read.
+func (c *Cache) SetWithTTL(key string, value interface{}, ttl time.Duration) {
+	n := c.evictions
+	c.set(key, value)
+	c.lastSetEvicted = c.evictions != n
+	c.expireAfter(key, ttl)
+}
+
+// expireAfter makes key, if present, expire after ttl
+func (c *Cache) expireAfter(key string, ttl time.Duration) {
+	if i, ok := c.get(key); ok {
+		x := c.items[i].ext()
+		x.expires = c.now().Add(ttl)
+		x.ttl = ttl
+	}
+}
+
+// GetE returns a value from the cache like Get, but reports why a value
+// could not be returned: ErrNotFound if the key is not present, ErrExpired if
+// its TTL has passed or its value is a SelfExpiring that has expired, or the
+// error returned by Loader, wrapped, if loading it failed.  If Loader is set,
+// missing and expired keys are loaded and stored instead of being reported as
+// errors.
+func (c *Cache) GetE(key string) (interface{}, error) {
+	i, err := c.lookupE(key)
+	if err == nil {
+		value := c.items[i].value
+		c.hit(i)
+		return value, nil
+	}
+
+	if c.Loader == nil {
+		return nil, err
+	}
+
+	value, lerr := c.Loader(key)
+	if lerr != nil {
+		return nil, fmt.Errorf("s4lru: loading %q: %w", key, lerr)
+	}
+
+	c.Set(key, value)
+	return value, nil
+}
+
+func (c *Cache) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+// SelfExpiring is implemented by values that know when they have gone stale.
+// Get consults Expired on every hit, and removes and reports as missing any
+// value for which it returns true, just like an item whose TTL has passed.
+type SelfExpiring interface {
+	Expired() bool
 }
 
-// Remove removes an item from the cache, returning the item and a boolean indicating if it was found
+// expired reports whether item's TTL has passed or its value says it is stale
+func (c *Cache) expired(item *cacheItem) bool {
+	if v, ok := item.value.(SelfExpiring); ok && v.Expired() {
+		return true
+	}
+	return item.extra != nil && !item.extra.expires.IsZero() && !c.now().Before(item.extra.expires)
+}
+
+// MoveToSegment moves an existing item to the front of segment seg.  Items
+// displaced from a full segment cascade down to the front of the next lower
+// segment, and items displaced from segment 0 are evicted.  MoveToSegment
+// returns false if the key isn't present or seg is out of range.
+func (c *Cache) MoveToSegment(key string, seg int) bool {
+	i, ok := c.get(key)
+	if !ok || seg < 0 || seg >= len(c.lists) {
+		return false
+	}
+
+	if c.Logger != nil {
+		c.Logger("move %q segment=%d->%d", key, c.items[i].lidx, seg)
+	}
+	if seg < c.items[i].lidx {
+		c.lists[c.items[i].lidx].evictions++
+	}
+	c.unlink(i)
+	c.link(seg, i)
+	c.cascade(seg)
+
+	return true
+}
+
+// SwapPositions exchanges the places of two items in the cache: a takes b's
+// segment and position within it, and b takes a's.  Values stay with their
+// keys.  It returns false, changing nothing, if either key isn't present.
+// In cost mode, a segment left over its budget by the exchange cascades down
+// as for MoveToSegment.
+func (c *Cache) SwapPositions(a, b string) bool {
+	i, ok := c.get(a)
+	if !ok {
+		return false
+	}
+	j, ok := c.get(b)
+	if !ok {
+		return false
+	}
+	if i == j {
+		return true
+	}
+
+	if c.Logger != nil {
+		c.Logger("swap %q segment=%d->%d with %q segment=%d->%d", a, c.items[i].lidx, c.items[j].lidx, b, c.items[j].lidx, c.items[i].lidx)
+	}
+
+	// the slots stay linked where they are and trade everything else
+	x, y := &c.items[i], &c.items[j]
+	c.lists[x.lidx].cost += y.cost - x.cost
+	c.lists[y.lidx].cost += x.cost - y.cost
+	xprev, xnext, xlidx := x.prev, x.next, x.lidx
+	yprev, ynext, ylidx := y.prev, y.next, y.lidx
+	*x, *y = *y, *x
+	x.prev, x.next, x.lidx = xprev, xnext, xlidx
+	y.prev, y.next, y.lidx = yprev, ynext, ylidx
+	c.put(a, j)
+	c.put(b, i)
+
+	if c.costFn != nil {
+		seg := x.lidx
+		if y.lidx > seg {
+			seg = y.lidx
+		}
+		c.cascade(seg)
+	}
+
+	return true
+}
+
+// cascade restores the size invariants of segment seg and every segment below
+// it by demoting the tail of each overfull segment to the front of the next
+// lower one, and evicting the tail of segment 0.
+func (c *Cache) cascade(seg int) {
+	for i := seg; i >= 0; i-- {
+		if i == 0 && c.evictBatch > 1 && c.over(0) {
+			c.trim(c.lowWatermark())
+		}
+		for c.over(i) {
+			b := c.lists[i].tail
+			if i == 0 {
+				if c.victim != nil || c.fifoAdmission {
+					b = c.victim0()
+				}
+				if b = c.coldestFree(b); b == 0 {
+					// everything is in use; stay over capacity for now
+					break
+				}
+				c.evict(b)
+				continue
+			}
+			c.unlink(b)
+			if c.Logger != nil {
+				c.Logger("demote %q segment=%d->%d", c.items[b].key, i, i-1)
+			}
+			c.lists[i].evictions++
+			c.link(i-1, b)
+		}
+	}
+}
+
+// Segments returns the number of segments in the cache
+func (c *Cache) Segments() int {
+	return len(c.lists)
+}
+
+// SegmentLens returns the number of items currently held in each segment
+func (c *Cache) SegmentLens() []int {
+	lens := make([]int, len(c.lists))
+	for i := range c.lists {
+		lens[i] = c.lists[i].Len()
+	}
+	return lens
+}
+
+// SegmentKeys returns the keys in segment seg, from the most to the least
+// recently used.  It does not promote anything.  SegmentKeys will panic if
+// seg is out of range.
+func (c *Cache) SegmentKeys(seg int) []string {
+	if seg < 0 || seg >= len(c.lists) {
+		panic("s4lru: segment out of range")
+	}
+	keys := make([]string, 0, c.lists[seg].Len())
+	for i := c.lists[seg].head; i != 0; i = c.items[i].next {
+		keys = append(keys, c.items[i].key)
+	}
+	return keys
+}
+
+// TopSegmentKeys returns the keys in the top segment, the protected set
+// least likely to be evicted, as SegmentKeys(Segments()-1) does
+func (c *Cache) TopSegmentKeys() []string {
+	return c.SegmentKeys(len(c.lists) - 1)
+}
+
+// ProtectedLen returns the number of items in the top segment
+func (c *Cache) ProtectedLen() int {
+	return c.lists[len(c.lists)-1].Len()
+}
+
+// SegmentValueSizes returns, for each segment, the sum of sizeOf over the
+// values it holds.  It is read-only and does not promote anything.
+func (c *Cache) SegmentValueSizes(sizeOf func(interface{}) int) []int {
+	sizes := make([]int, len(c.lists))
+	for seg := range c.lists {
+		for i := c.lists[seg].head; i != 0; i = c.items[i].next {
+			sizes[seg] += sizeOf(c.items[i].value)
+		}
+	}
+	return sizes
+}
+
+// SegmentEvictions returns, for each segment, the number of items that have
+// left it downwards: demoted to the segment below, swapped down by a
+// promotion, moved down by MoveToSegment, or, for any segment, evicted from
+// the cache.  Segments that shed many items may be too small.  The counts
+// start again from zero after Reshape or Restore.
+func (c *Cache) SegmentEvictions() []uint64 {
+	n := make([]uint64, len(c.lists))
+	for i := range c.lists {
+		n[i] = c.lists[i].evictions
+	}
+	return n
+}
+
+// Occupancy reports how full a single segment is
+type Occupancy struct {
+	Len int // items currently in the segment
+	Cap int // maximum number of items the segment can hold
+}
+
+// OccupancyHistogram returns the length and capacity of each segment, from
+// segment 0 (the admission segment) to the top segment.
+func (c *Cache) OccupancyHistogram() []Occupancy {
+	h := make([]Occupancy, len(c.lists))
+	for i := range c.lists {
+		h[i] = Occupancy{Len: c.lists[i].Len(), Cap: c.caps[i]}
+	}
+	return h
+}
+
+// ResetSegment evicts every item in segment seg, calling OnEvict for each,
+// and returns the number of items evicted.  The other segments are left
+// untouched.  ResetSegment will panic if seg is out of range.
+func (c *Cache) ResetSegment(seg int) int {
+	if seg < 0 || seg >= len(c.lists) {
+		panic("s4lru: segment out of range")
+	}
+
+	n := 0
+	for c.lists[seg].head != 0 {
+		i := c.lists[seg].head
+		c.evicted(i, seg)
+		c.unlink(i)
+		c.delStored(c.items[i].key)
+		c.release(i)
+		n++
+	}
+	return n
+}
+
+// Remove removes an item from the cache, returning the item and a boolean indicating if it was found.
+// During ForEach, the item is only unlinked once the walk is over.
 func (c *Cache) Remove(key string) (interface{}, bool) {
-	v, ok := c.data[key]
+	c.record(OpRemove, key)
+	i, ok := c.get(key)
 
 	if !ok {
 		return nil, false
 	}
 
-	item := v.Value.(*cacheItem)
+	value := c.items[i].value
+	seg := c.items[i].lidx
+
+	c.del(key)
+	if c.departed != nil {
+		c.departed.add(c.items[i].key)
+	}
+
+	if c.walking > 0 {
+		// leave the item linked for ForEach to step over
+		c.tombstones = append(c.tombstones, i)
+	} else {
+		c.unlink(i)
+		c.release(i)
+		if c.backfillOnRemove {
+			c.backfill(seg)
+		}
+	}
+
+	if c.OnRemove != nil {
+		c.OnRemove(key, value)
+	}
+
+	return value, true
+}
+
+// RemoveMulti removes each of keys from the cache and returns those that
+// were present, in the order given
+func (c *Cache) RemoveMulti(keys []string) []string {
+	var removed []string
+	for _, key := range keys {
+		if _, ok := c.Remove(key); ok {
+			removed = append(removed, key)
+		}
+	}
+	return removed
+}
+
+// backfill fills a free slot in segment seg by pulling up the tail of the
+// segment below to the back of seg, repeating downwards so that the gap ends
+// up in segment 0.
+func (c *Cache) backfill(seg int) {
+	for ; seg > 0; seg-- {
+		b := c.lists[seg-1].tail
+		if b == 0 || !c.fits(seg, c.items[b].cost) {
+			return
+		}
+		if c.Logger != nil {
+			c.Logger("backfill %q segment=%d->%d", c.items[b].key, seg-1, seg)
+		}
+		c.unlink(b)
+		c.linkBack(seg, b)
+	}
+}
+
+// Reshape rebuilds the cache with the given number of segments, keeping the
+// total capacity and dividing it between the new segments as New does,
+// except that small caches are not collapsed to a single segment.
+//
+// Items keep their relative recency order: each one is mapped to the
+// proportionally equivalent new segment, never above an item that was hotter
+// than it, and spills down into lower segments when its target is full.
+// Items that no longer fit anywhere are evicted coldest-first.  While the
+// cache is unbounded, see SetUnbounded, nothing is evicted: every item goes
+// to its proportionally equivalent segment, however full.
+//
+// Reshape is a heavyweight O(n) operation and is intended for
+// experimentation rather than use on a hot path.
+func (c *Cache) Reshape(segments int) {
+	if segments < 1 {
+		panic("s4lru: segments must be at least 1")
+	}
+	if c.costFn != nil {
+		panic("s4lru: Reshape is not supported in cost mode")
+	}
+
+	total := c.Capacity()
+
+	// collect the items from hottest to coldest
+	order := make([]int32, 0, c.count())
+	for seg := len(c.lists) - 1; seg >= 0; seg-- {
+		for i := c.lists[seg].head; i != 0; i = c.items[i].next {
+			order = append(order, i)
+		}
+	}
 
-	c.lists[item.lidx].Remove(v)
+	oldSegments := len(c.lists)
+	c.caps = splitCapacity(total, segments)
+	c.raiseAdmission()
+	c.lists = make([]itemList, segments)
+	c.transitions = nil
+	if c.adapt != nil {
+		*c.adapt = adaptive{interval: c.adapt.interval}
+	}
 
-	delete(c.data, key)
+	seg := segments - 1
+	for _, i := range order {
+		old := c.items[i].lidx
+		if m := old * segments / oldSegments; m < seg {
+			seg = m
+		}
+		for !c.unbounded && seg >= 0 && c.lists[seg].Len() >= c.caps[seg] {
+			seg--
+		}
+		if seg < 0 {
+			// it fell out the bottom of the new segments, which old
+			// may be past the end of
+			c.evicted(i, 0)
+			c.delStored(c.items[i].key)
+			c.release(i)
+			continue
+		}
+		c.linkBack(seg, i)
+	}
+}
 
-	return item.value, true
+// SetUnbounded turns off eviction, or back on.  While unbounded, the cache
+// stores every item it is given, letting each segment grow past its
+// capacity, for batch jobs that load a bounded data set before querying
+// it; memory use is then limited only by what the caller stores.  Turning
+// it off again compacts the cache to its capacity, as Compact(Capacity())
+// does.  SetUnbounded will panic in cost mode.
+func (c *Cache) SetUnbounded(unbounded bool) {
+	if c.costFn != nil {
+		panic("s4lru: SetUnbounded is not supported in cost mode")
+	}
+	if unbounded {
+		c.unbounded = true
+		return
+	}
+	c.Compact(c.Capacity())
+}
+
+// Compact makes capacity the cache's capacity, and evicts the coldest items,
+// in EvictionOrder, until the rest fit.  The segments keep their capacities
+// if capacity is unchanged, as after SetUnbounded(false), and are otherwise
+// scaled to it in proportion; either way segment 0 keeps any minimum set
+// WithMinAdmission.  The survivors keep their order and are laid out afresh from
+// the top segment down, the hottest filling the top segment.  Compact also
+// ends unbounded mode, see SetUnbounded.  It is O(n), and will panic if
+// capacity is negative or in cost mode.
+func (c *Cache) Compact(capacity int) {
+	if capacity < 0 {
+		panic("s4lru: negative capacity")
+	}
+	if c.costFn != nil {
+		panic("s4lru: Compact is not supported in cost mode")
+	}
+	c.unbounded = false
+
+	// evict from the coldest end until the rest fit
+	for n := c.count(); n > capacity; n-- {
+		seg := 0
+		for c.lists[seg].tail == 0 {
+			seg++
+		}
+		c.evict(c.lists[seg].tail)
+	}
+
+	// collect the survivors from hottest to coldest
+	order := make([]int32, 0, c.count())
+	for seg := len(c.lists) - 1; seg >= 0; seg-- {
+		for i := c.lists[seg].head; i != 0; i = c.items[i].next {
+			order = append(order, i)
+		}
+	}
+
+	if capacity != c.Capacity() {
+		c.caps = scaleCapacity(c.caps, capacity)
+		c.raiseAdmission()
+	}
+	for seg := range c.lists {
+		c.lists[seg] = itemList{evictions: c.lists[seg].evictions}
+	}
+	if c.adapt != nil {
+		*c.adapt = adaptive{interval: c.adapt.interval}
+	}
+
+	seg := len(c.lists) - 1
+	for _, i := range order {
+		for c.lists[seg].Len() >= c.caps[seg] {
+			seg--
+		}
+		c.linkBack(seg, i)
+	}
 }
@@ -1,8 +1,15 @@
 package s4lru
 
 import (
+	"errors"
 	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCache(t *testing.T) {
@@ -49,3 +56,2403 @@ func TestCache(t *testing.T) {
 	}
 
 }
+
+func TestOccupancyHistogram(t *testing.T) {
+
+	c := New(16)
+
+	// four cold items in segment 0, two of them promoted into segment 1, one
+	// of those promoted again into segment 2
+	for i := 0; i < 4; i++ {
+		c.Set(fmt.Sprintf("key%d", i), i)
+	}
+	c.Get("key0")
+	c.Get("key1")
+	c.Get("key1")
+
+	want := []Occupancy{{2, 4}, {1, 4}, {1, 4}, {0, 4}}
+
+	h := c.OccupancyHistogram()
+	if len(h) != len(want) {
+		t.Fatalf("OccupancyHistogram returned %d segments, want %d", len(h), len(want))
+	}
+
+	lens := c.SegmentLens()
+	total := 0
+	for i := range want {
+		if h[i] != want[i] {
+			t.Errorf("segment %d: got %+v, want %+v", i, h[i], want[i])
+		}
+		if lens[i] != h[i].Len {
+			t.Errorf("segment %d: SegmentLens=%d, histogram Len=%d", i, lens[i], h[i].Len)
+		}
+		total += h[i].Len
+	}
+
+	if total != c.Len() {
+		t.Errorf("histogram sums to %d items, Len()=%d", total, c.Len())
+	}
+}
+
+func TestReshape(t *testing.T) {
+
+	c := New(16)
+
+	// segment 0: key3 key2, segment 1: key1, segment 2: key0
+	for i := 0; i < 4; i++ {
+		c.Set(fmt.Sprintf("key%d", i), i)
+	}
+	c.Get("key0")
+	c.Get("key0")
+	c.Get("key1")
+
+	c.Reshape(2)
+
+	if n := c.Segments(); n != 2 {
+		t.Fatalf("Segments()=%d after Reshape(2)", n)
+	}
+
+	if c.Len() != 4 {
+		t.Errorf("Reshape lost items: Len()=%d, want 4", c.Len())
+	}
+
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if j, ok := c.data[key]; !ok || c.items[j].value.(int) != i {
+			t.Errorf("key %q not preserved by Reshape", key)
+		}
+	}
+
+	// key0 (old segment 2) maps to the top segment, key1 (old segment 1)
+	// and the cold keys map to segment 0
+	want := []Occupancy{{3, 8}, {1, 8}}
+	for i, o := range c.OccupancyHistogram() {
+		if o != want[i] {
+			t.Errorf("segment %d: got %+v, want %+v", i, o, want[i])
+		}
+	}
+
+	if seg := c.items[c.data["key0"]].lidx; seg != 1 {
+		t.Errorf("key0 in segment %d, want 1", seg)
+	}
+
+	// the new per-segment limit is 8: overfilling segment 0 evicts the
+	// coldest item, key2
+	for i := 4; i < 10; i++ {
+		c.Set(fmt.Sprintf("key%d", i), i)
+	}
+
+	if n := c.lists[0].Len(); n != 8 {
+		t.Errorf("segment 0 holds %d items, want 8", n)
+	}
+
+	if _, ok := c.data["key2"]; ok {
+		t.Errorf("coldest key2 survived overfilling segment 0")
+	}
+
+	if _, ok := c.data["key3"]; !ok {
+		t.Errorf("key3 evicted before the coldest key2")
+	}
+}
+
+// segmentKeys returns the keys in segment i, front to back
+func segmentKeys(c *Cache, i int) []string {
+	var keys []string
+	for j := c.lists[i].head; j != 0; j = c.items[j].next {
+		keys = append(keys, c.items[j].key)
+	}
+	return keys
+}
+
+func TestMoveToSegment(t *testing.T) {
+
+	c := New(8)
+
+	// segment 3: b a, segment 0: d c
+	for _, k := range []string{"a", "b"} {
+		c.Set(k, k)
+		for i := 0; i < 3; i++ {
+			c.Get(k)
+		}
+	}
+	c.Set("c", "c")
+	c.Set("d", "d")
+
+	if c.MoveToSegment("missing", 3) {
+		t.Errorf("moved a missing key")
+	}
+	if c.MoveToSegment("c", 4) || c.MoveToSegment("c", -1) {
+		t.Errorf("moved a key to an out of range segment")
+	}
+
+	// the full top segment sheds its tail, a, into segment 2
+	if !c.MoveToSegment("c", 3) {
+		t.Fatalf("failed to move c into segment 3")
+	}
+
+	want := [][]string{{"d"}, nil, {"a"}, {"c", "b"}}
+	for i := range want {
+		if got := segmentKeys(c, i); fmt.Sprint(got) != fmt.Sprint(want[i]) {
+			t.Errorf("segment %d: got %v, want %v", i, got, want[i])
+		}
+		for _, k := range want[i] {
+			if seg := c.items[c.data[k]].lidx; seg != i {
+				t.Errorf("key %q has lidx %d, want %d", k, seg, i)
+			}
+		}
+	}
+
+	// moving into a full segment 0 evicts its tail
+	c.Set("e", "e")
+	if !c.MoveToSegment("b", 0) {
+		t.Fatalf("failed to move b into segment 0")
+	}
+
+	want = [][]string{{"b", "e"}, nil, {"a"}, {"c"}}
+	for i := range want {
+		if got := segmentKeys(c, i); fmt.Sprint(got) != fmt.Sprint(want[i]) {
+			t.Errorf("segment %d: got %v, want %v", i, got, want[i])
+		}
+	}
+
+	if _, ok := c.Get("d"); ok {
+		t.Errorf("tail of segment 0 was not evicted")
+	}
+}
+
+// fakeClock is a manually advanced clock for TTL tests
+type fakeClock struct {
+	t time.Time
+}
+
+func (f *fakeClock) Now() time.Time { return f.t }
+
+func (f *fakeClock) Advance(d time.Duration) { f.t = f.t.Add(d) }
+
+func TestGetE(t *testing.T) {
+
+	clock := &fakeClock{t: time.Unix(0, 0)}
+
+	c := New(8)
+	c.Now = clock.Now
+
+	if _, err := c.GetE("missing"); err != ErrNotFound {
+		t.Errorf("GetE(missing): got %v, want ErrNotFound", err)
+	}
+
+	c.Set("forever", 1)
+	c.SetWithTTL("short", 2, time.Second)
+
+	if v, err := c.GetE("short"); err != nil || v.(int) != 2 {
+		t.Errorf("GetE(short) before expiry: got %v, %v", v, err)
+	}
+
+	clock.Advance(time.Second)
+
+	if _, err := c.GetE("short"); err != ErrExpired {
+		t.Errorf("GetE(short) after expiry: got %v, want ErrExpired", err)
+	}
+
+	if _, err := c.GetE("short"); err != ErrNotFound {
+		t.Errorf("expired key was not removed: got %v, want ErrNotFound", err)
+	}
+
+	if v, err := c.GetE("forever"); err != nil || v.(int) != 1 {
+		t.Errorf("GetE(forever): got %v, %v", v, err)
+	}
+
+	errBackend := errors.New("backend unavailable")
+	c.Loader = func(key string) (interface{}, error) {
+		if key == "bad" {
+			return nil, errBackend
+		}
+		return key + "!", nil
+	}
+
+	if _, err := c.GetE("bad"); !errors.Is(err, errBackend) {
+		t.Errorf("GetE(bad): got %v, want wrapped loader error", err)
+	}
+
+	if v, err := c.GetE("good"); err != nil || v.(string) != "good!" {
+		t.Errorf("GetE(good): got %v, %v", v, err)
+	}
+
+	if v, ok := c.Get("good"); !ok || v.(string) != "good!" {
+		t.Errorf("loaded value was not stored")
+	}
+}
+
+func TestUnevenSegments(t *testing.T) {
+
+	c := NewWithSegments([]int{2, 0, 2})
+
+	c.Set("foo", "bar")
+	c.Set("baz", "qux")
+
+	// the next segment has no capacity, so Get must not panic trying to
+	// swap with its (missing) tail
+	for i := 0; i < 3; i++ {
+		if v, ok := c.Get("baz"); !ok || v.(string) != "qux" {
+			t.Fatalf("failed to get key from cache with an empty segment")
+		}
+	}
+
+	if got := segmentKeys(c, 0); fmt.Sprint(got) != "[baz foo]" {
+		t.Errorf("segment 0: got %v, want [baz foo]", got)
+	}
+
+	// a cache whose admission segment has no capacity stores nothing
+	z := NewWithSegments([]int{0, 4})
+	z.Set("foo", "bar")
+	if _, ok := z.Get("foo"); ok || z.Len() != 0 {
+		t.Errorf("stored an item in a zero-capacity segment")
+	}
+}
+
+func TestLogger(t *testing.T) {
+
+	c := NewWithSegments([]int{2, 1})
+
+	var got []string
+	c.Logger = func(format string, args ...interface{}) {
+		got = append(got, fmt.Sprintf(format, args...))
+	}
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a")
+	c.Get("b")
+	c.Set("c", 3)
+	c.Set("d", 4)
+	c.MoveToSegment("c", 1)
+
+	want := []string{
+		`insert "a" segment=0`,
+		`insert "b" segment=0`,
+		`promote "a" segment=0->1`,
+		`swap "b" segment=0->1 with "a" segment=1->0`,
+		`insert "c" segment=0`,
+		`evict "a" segment=0`,
+		`insert "d" segment=0`,
+		`move "c" segment=0->1`,
+		`demote "b" segment=1->0`,
+	}
+
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+		t.Errorf("log mismatch:\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestGetTrace(t *testing.T) {
+
+	c := New(8)
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	// a climbs to the top and stays there, b follows it up, x is never
+	// present
+	trace := c.GetTrace([]string{"a", "x", "a", "a", "a", "b", "b", "b", "b", "b"})
+	want := []int{1, -1, 2, 3, 3, 1, 2, 3, 3, 3}
+
+	if fmt.Sprint(trace) != fmt.Sprint(want) {
+		t.Errorf("GetTrace: got %v, want %v", trace, want)
+	}
+}
+
+func BenchmarkGetPromote(b *testing.B) {
+
+	c := NewWithSegments([]int{1, 1})
+	c.Set("a", 1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// each Get moves a from segment 0 into the empty segment 1
+	for i := 0; i < b.N; i++ {
+		c.MoveToSegment("a", 0)
+		c.Get("a")
+	}
+}
+
+func BenchmarkGetSwap(b *testing.B) {
+
+	c := NewWithSegments([]int{1, 1})
+	c.Set("a", 1)
+	c.Get("a")
+	c.Set("b", 2)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// each Get swaps the key in segment 0 with the one in segment 1
+	keys := [2]string{"b", "a"}
+	for i := 0; i < b.N; i++ {
+		c.Get(keys[i&1])
+	}
+}
+
+// thrashCache returns a cache with every segment full, so that any Get
+// below the top segment takes the swap path
+func thrashCache(segments, per int, opts ...Option) *Cache {
+	caps := make([]int, segments)
+	for seg := range caps {
+		caps[seg] = per
+	}
+	c := NewWithSegments(caps, opts...)
+	for seg := segments - 1; seg >= 0; seg-- {
+		for n := 0; n < per; n++ {
+			c.SetWithSegment("s"+strconv.Itoa(seg)+"-"+strconv.Itoa(n), n, seg)
+		}
+	}
+	return c
+}
+
+// thrashKey returns the key at the tail of the segment below the top that
+// the nth Get of the thrash pattern hits
+func thrashKey(c *Cache, n int) string {
+	return c.items[c.lists[n%(len(c.lists)-1)].tail].key
+}
+
+func BenchmarkSwapThrash(b *testing.B) {
+
+	c := thrashCache(4, 256)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// each Get hits the tail of a segment whose next segment is full, the
+	// worst case for promotion: every one swaps
+	for i := 0; i < b.N; i++ {
+		c.Get(thrashKey(c, i))
+	}
+}
+
+// benchTrace returns a skewed sequence of n lookups over 2*capacity keys
+func benchTrace(capacity, n int) []string {
+	r := rand.New(rand.NewSource(1))
+	z := rand.NewZipf(r, 1.1, 1, uint64(2*capacity-1))
+	trace := make([]string, n)
+	for i := range trace {
+		trace[i] = strconv.FormatUint(z.Uint64(), 10)
+	}
+	return trace
+}
+
+func BenchmarkGet(b *testing.B) {
+
+	const capacity = 1 << 12
+	trace := benchTrace(capacity, 1<<16)
+
+	c := New(capacity)
+	for _, key := range trace {
+		if _, ok := c.Get(key); !ok {
+			c.Set(key, key)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c.Get(trace[i&(len(trace)-1)])
+	}
+}
+
+func BenchmarkSet(b *testing.B) {
+
+	const capacity = 1 << 12
+	keys := make([]string, 4*capacity)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	c := New(capacity)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// removing a recently inserted key first leaves a free slot in
+	// segment 0, so each Set links in a new item rather than reusing the tail
+	for i := 0; i < b.N; i++ {
+		c.Remove(keys[(i-capacity/8)&(len(keys)-1)])
+		c.Set(keys[i&(len(keys)-1)], nil)
+	}
+}
+
+// BenchmarkEvictionBatch inserts a stream of new keys into a full cache,
+// reporting how many of the Sets had to run an eviction pass
+func BenchmarkEvictionBatch(b *testing.B) {
+
+	const capacity = 1 << 12
+	keys := make([]string, 4*capacity)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	for _, n := range []int{1, 16, 256} {
+		b.Run("batch="+strconv.Itoa(n), func(b *testing.B) {
+			c := New(capacity, WithEvictionBatch(n))
+			for _, key := range keys {
+				c.Set(key, nil)
+			}
+
+			passes := 0
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				before := c.lists[0].Len()
+				c.Set(keys[i&(len(keys)-1)], nil)
+				if c.lists[0].Len() <= before {
+					passes++
+				}
+			}
+			b.ReportMetric(float64(passes)/float64(b.N), "passes/op")
+		})
+	}
+}
+
+// BenchmarkFill creates a cache and fills every segment, comparing a cache
+// sized up front with one that grows as it fills
+func BenchmarkFill(b *testing.B) {
+
+	const capacity = 1 << 12
+	keys := make([]string, capacity)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	for _, hint := range []int{0, capacity} {
+		b.Run("hint="+strconv.Itoa(hint), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c := NewWithHint(capacity, hint)
+				for j, key := range keys {
+					c.SetWithSegment(key, nil, j%4)
+				}
+			}
+		})
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+
+	c := New(16, WithAdaptive(8))
+
+	// two hot keys live in the top segment and take every hit
+	for _, k := range []string{"a", "b"} {
+		c.Set(k, k)
+		for i := 0; i < 3; i++ {
+			c.Get(k)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		c.Set(fmt.Sprintf("cold%d", i), i)
+	}
+
+	for i := 0; i < 400; i++ {
+		c.Get("a")
+		c.Get("b")
+	}
+
+	h := c.OccupancyHistogram()
+
+	total := 0
+	for _, o := range h {
+		total += o.Cap
+		if o.Cap < 1 {
+			t.Errorf("a segment shrank below one slot: %+v", h)
+		}
+	}
+	if total != 16 {
+		t.Errorf("total capacity changed to %d", total)
+	}
+
+	if h[3].Cap <= 4 {
+		t.Errorf("busy top segment did not grow: %+v", h)
+	}
+	if h[1].Cap >= 4 || h[2].Cap >= 4 {
+		t.Errorf("idle middle segments did not shrink: %+v", h)
+	}
+
+	for _, k := range []string{"a", "b"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("rebalancing evicted hot key %q", k)
+		}
+	}
+}
+
+type staleValue struct {
+	stale bool
+}
+
+func (v *staleValue) Expired() bool { return v.stale }
+
+func TestSelfExpiring(t *testing.T) {
+
+	c := New(8)
+
+	v := &staleValue{}
+	c.Set("foo", v)
+	c.Set("bar", &staleValue{})
+
+	if got, ok := c.Get("foo"); !ok || got != v {
+		t.Errorf("failed to get fresh self-expiring value")
+	}
+
+	v.stale = true
+
+	if _, ok := c.Get("foo"); ok {
+		t.Errorf("got a value that reports itself expired")
+	}
+
+	if c.Len() != 1 {
+		t.Errorf("expired value was not removed: Len()=%d", c.Len())
+	}
+
+	c.items[c.data["bar"]].value.(*staleValue).stale = true
+
+	if _, err := c.GetE("bar"); err != ErrExpired {
+		t.Errorf("GetE on an expired value: got %v, want ErrExpired", err)
+	}
+}
+
+func TestRebalanceOnRemove(t *testing.T) {
+
+	setup := func(opts ...Option) *Cache {
+		c := NewWithSegments([]int{2, 2, 2}, opts...)
+		// segment 2: a, segment 1: c b, segment 0: e d
+		c.Set("a", "a")
+		c.Get("a")
+		c.Get("a")
+		c.Set("b", "b")
+		c.Get("b")
+		c.Set("c", "c")
+		c.Get("c")
+		c.Set("d", "d")
+		c.Set("e", "e")
+		return c
+	}
+
+	c := setup()
+	c.Remove("b")
+	if got := fmt.Sprint(c.SegmentLens()); got != "[2 1 1]" {
+		t.Errorf("plain Remove changed other segments: %v", got)
+	}
+
+	c = setup(WithRebalanceOnRemove())
+	c.Remove("b")
+
+	want := [][]string{{"e"}, {"c", "d"}, {"a"}}
+	for i := range want {
+		if got := segmentKeys(c, i); fmt.Sprint(got) != fmt.Sprint(want[i]) {
+			t.Errorf("segment %d: got %v, want %v", i, got, want[i])
+		}
+	}
+}
+
+func TestGhost(t *testing.T) {
+
+	c := New(8, WithGhost(4))
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+
+	if _, ok := c.Get("a"); ok {
+		t.Fatalf("a was not evicted")
+	}
+
+	// a comes back soon after being evicted, d is new
+	c.Set("a", 1)
+	c.Set("d", 4)
+
+	if seg := c.items[c.data["a"]].lidx; seg != 1 {
+		t.Errorf("recently evicted key a inserted into segment %d, want 1", seg)
+	}
+	if seg := c.items[c.data["d"]].lidx; seg != 0 {
+		t.Errorf("cold key d inserted into segment %d, want 0", seg)
+	}
+
+	// once readmitted, a is no longer a ghost
+	if c.ghost.contains("a") {
+		t.Errorf("readmitted key is still in the ghost list")
+	}
+
+	// the ghost list only remembers the last four evictions
+	for i := 0; i < 6; i++ {
+		c.Set(fmt.Sprintf("cold%d", i), i)
+	}
+	c.Set("b", 2)
+	if seg := c.items[c.data["b"]].lidx; seg != 0 {
+		t.Errorf("long-forgotten ghost b inserted into segment %d, want 0", seg)
+	}
+}
+
+func TestSmallCache(t *testing.T) {
+
+	for capacity := 1; capacity < 4; capacity++ {
+		c := New(capacity)
+
+		if c.Segments() != 1 || c.Capacity() != capacity {
+			t.Errorf("New(%d): %d segments, capacity %d", capacity, c.Segments(), c.Capacity())
+		}
+
+		for i := 0; i < capacity; i++ {
+			c.Set(fmt.Sprintf("key%d", i), i)
+		}
+		if c.Len() != capacity {
+			t.Errorf("New(%d) holds %d items", capacity, c.Len())
+		}
+
+		// a plain LRU: touching the oldest key saves it from the next eviction
+		c.Get("key0")
+		c.Set("extra", -1)
+
+		if c.Len() != capacity {
+			t.Errorf("New(%d) holds %d items after an eviction", capacity, c.Len())
+		}
+		if _, ok := c.Get("extra"); !ok {
+			t.Errorf("New(%d) did not store the newest key", capacity)
+		}
+		if _, ok := c.Get("key0"); !ok && capacity > 1 {
+			t.Errorf("New(%d) evicted the most recently used key", capacity)
+		}
+	}
+}
+
+func TestUnevenCapacity(t *testing.T) {
+
+	c := New(10)
+
+	if got := fmt.Sprint(c.caps); got != "[3 3 2 2]" {
+		t.Errorf("New(10) segment capacities %v, want [3 3 2 2]", got)
+	}
+	if c.Capacity() != 10 {
+		t.Errorf("New(10).Capacity()=%d", c.Capacity())
+	}
+}
+
+func TestAccessCount(t *testing.T) {
+
+	c := New(8, WithAccessCounts())
+
+	if _, ok := c.AccessCount("foo"); ok {
+		t.Errorf("got an access count for a missing key")
+	}
+
+	c.Set("foo", 1)
+
+	for i := 1; i <= 5; i++ {
+		c.Get("foo")
+		if n, ok := c.AccessCount("foo"); !ok || n != i {
+			t.Errorf("after %d Gets: AccessCount=%d, %v", i, n, ok)
+		}
+	}
+
+	// push foo out of the cache: it is in the top segment, so demote it first
+	c.MoveToSegment("foo", 0)
+	c.Set("bar", 2)
+	c.Set("baz", 3)
+
+	if _, ok := c.AccessCount("foo"); ok {
+		t.Fatalf("foo was not evicted")
+	}
+
+	c.Set("foo", 1)
+
+	if n, ok := c.AccessCount("foo"); !ok || n != 0 {
+		t.Errorf("re-inserted key kept its old count: %d, %v", n, ok)
+	}
+
+	// without the option nothing is counted
+	p := New(8)
+	p.Set("foo", 1)
+	p.Get("foo")
+	if n, _ := p.AccessCount("foo"); n != 0 {
+		t.Errorf("counted accesses without WithAccessCounts: %d", n)
+	}
+}
+
+func TestSetWithSegment(t *testing.T) {
+
+	c := New(8)
+
+	c.Set("a", 1)
+	c.SetWithSegment("b", 2, 2)
+	c.SetWithSegment("c", 3, 2)
+	c.SetWithSegment("d", 4, 2)
+
+	// d and c fill segment 2, b is displaced into segment 1
+	want := [][]string{{"a"}, {"b"}, {"d", "c"}, nil}
+	for i := range want {
+		if got := segmentKeys(c, i); fmt.Sprint(got) != fmt.Sprint(want[i]) {
+			t.Errorf("segment %d: got %v, want %v", i, got, want[i])
+		}
+	}
+
+	// an existing key is updated and moved
+	c.SetWithSegment("a", 10, 3)
+	if item := c.items[c.data["a"]]; item.value.(int) != 10 || item.lidx != 3 {
+		t.Errorf("existing key a: value %v in segment %d, want 10 in segment 3", item.value, item.lidx)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("SetWithSegment did not panic for an out of range segment")
+		}
+	}()
+	c.SetWithSegment("e", 5, 4)
+}
+
+func TestPromoteAllocs(t *testing.T) {
+
+	// two single-slot segments, both full: every Get swaps the two keys
+	c := NewWithSegments([]int{1, 1})
+	c.Set("a", 1)
+	c.Get("a")
+	c.Set("b", 2)
+
+	keys := [2]string{"b", "a"}
+	n := 0
+	swap := func() {
+		c.Get(keys[n&1])
+		n++
+	}
+
+	swap()
+	if seg := c.items[c.data["b"]].lidx; seg != 1 {
+		t.Fatalf("Get did not take the swap path: b in segment %d", seg)
+	}
+
+	if allocs := testing.AllocsPerRun(1000, swap); allocs != 0 {
+		t.Errorf("swap path: %v allocs per Get, want 0", allocs)
+	}
+
+	// a single key bouncing between an empty segment 1 and segment 0
+	m := NewWithSegments([]int{1, 1})
+	m.Set("a", 1)
+	move := func() {
+		m.MoveToSegment("a", 0)
+		m.Get("a")
+	}
+
+	if allocs := testing.AllocsPerRun(1000, move); allocs != 0 {
+		t.Errorf("move path: %v allocs per Get, want 0", allocs)
+	}
+}
+
+func TestSegmentValueSizes(t *testing.T) {
+
+	c := New(8)
+
+	c.Set("a", "xxxxxxxx")
+	c.Get("a")
+	c.Set("b", "xxxx")
+	c.Set("c", "xx")
+
+	sizes := c.SegmentValueSizes(func(v interface{}) int { return len(v.(string)) })
+	if got := fmt.Sprint(sizes); got != "[6 8 0 0]" {
+		t.Errorf("SegmentValueSizes()=%v, want [6 8 0 0]", got)
+	}
+
+	if seg := c.items[c.data["a"]].lidx; seg != 1 {
+		t.Errorf("SegmentValueSizes promoted a to segment %d", seg)
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+
+	c := New(4)
+
+	var evicted []string
+	c.OnEvict = func(key string, value interface{}) {
+		evicted = append(evicted, fmt.Sprintf("%s=%v", key, value))
+	}
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Remove("b")
+	c.Set("c", 3)
+
+	if got := fmt.Sprint(evicted); got != "[a=1]" {
+		t.Errorf("evicted %v, want [a=1]", got)
+	}
+}
+
+func TestResetSegment(t *testing.T) {
+
+	c := New(16)
+
+	c.Set("hot", 0)
+	c.Get("hot")
+	c.Get("hot")
+	c.Set("warm", 0)
+	c.Get("warm")
+	for i := 0; i < 3; i++ {
+		c.Set(fmt.Sprintf("cold%d", i), i)
+	}
+
+	var evicted []string
+	c.OnEvict = func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	}
+
+	if n := c.ResetSegment(0); n != 3 {
+		t.Errorf("ResetSegment(0) removed %d items, want 3", n)
+	}
+
+	if got := fmt.Sprint(evicted); got != "[cold2 cold1 cold0]" {
+		t.Errorf("OnEvict saw %v, want [cold2 cold1 cold0]", got)
+	}
+
+	if got := fmt.Sprint(c.SegmentLens()); got != "[0 1 1 0]" {
+		t.Errorf("segment lengths after ResetSegment(0): %v, want [0 1 1 0]", got)
+	}
+
+	for _, k := range []string{"hot", "warm"} {
+		if _, ok := c.Peek(k); !ok {
+			t.Errorf("ResetSegment(0) removed %q from an upper segment", k)
+		}
+	}
+
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("ResetSegment did not panic for an out of range segment")
+		}
+	}()
+	c.ResetSegment(4)
+}
+
+func TestGetNoPromote(t *testing.T) {
+
+	c := New(8, WithStats(true))
+
+	c.Set("foo", "bar")
+
+	for i := 0; i < 3; i++ {
+		if v, ok := c.GetNoPromote("foo"); !ok || v.(string) != "bar" {
+			t.Errorf("GetNoPromote: got %v, %v", v, ok)
+		}
+	}
+
+	if _, ok := c.GetNoPromote("missing"); ok {
+		t.Errorf("GetNoPromote found a missing key")
+	}
+
+	if seg := c.items[c.data["foo"]].lidx; seg != 0 {
+		t.Errorf("GetNoPromote moved foo to segment %d", seg)
+	}
+
+	if st := c.Stats(); st.Hits != 3 || st.Misses != 1 {
+		t.Errorf("Stats()=%+v, want 3 hits and 1 miss", st)
+	}
+}
+
+func TestSlidingTTL(t *testing.T) {
+
+	clock := &fakeClock{t: time.Unix(0, 0)}
+
+	c := New(16, WithSlidingTTL())
+	c.Now = clock.Now
+
+	c.SetWithTTL("busy", 1, time.Minute)
+	c.SetWithTTL("idle", 2, time.Minute)
+	c.Set("forever", 3)
+
+	// busy is read every 30s for ten minutes, idle never
+	for i := 0; i < 20; i++ {
+		clock.Advance(30 * time.Second)
+		if _, ok := c.Get("busy"); !ok {
+			t.Fatalf("frequently read item expired after %v", time.Duration(i+1)*30*time.Second)
+		}
+	}
+
+	if _, ok := c.Get("idle"); ok {
+		t.Errorf("idle item did not expire")
+	}
+
+	if _, ok := c.Get("forever"); !ok {
+		t.Errorf("item without a TTL expired")
+	}
+
+	// once reads stop, busy expires a TTL after the last one
+	clock.Advance(59 * time.Second)
+	if _, ok := c.Peek("busy"); !ok {
+		t.Errorf("item expired before its TTL since the last read")
+	}
+	clock.Advance(time.Second)
+	if _, ok := c.Get("busy"); ok {
+		t.Errorf("item did not expire a TTL after the last read")
+	}
+}
+
+func TestTouchMulti(t *testing.T) {
+
+	c := New(16)
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+	c.Get("b")
+
+	if n := c.TouchMulti([]string{"a", "b", "missing", "x"}); n != 2 {
+		t.Errorf("TouchMulti found %d keys, want 2", n)
+	}
+
+	for k, want := range map[string]int{"a": 1, "b": 2, "c": 0} {
+		if seg := c.items[c.data[k]].lidx; seg != want {
+			t.Errorf("key %q in segment %d, want %d", k, seg, want)
+		}
+	}
+}
+
+func TestVictimSelector(t *testing.T) {
+
+	var c *Cache
+
+	// least frequently used, breaking ties in LRU order
+	lfu := func(keys []string) string {
+		victim, least := keys[0], -1
+		for _, k := range keys {
+			if n, _ := c.AccessCount(k); least < 0 || n < least {
+				victim, least = k, n
+			}
+		}
+		return victim
+	}
+
+	c = New(8, WithAccessCounts(), WithVictimSelector(lfu))
+
+	c.Set("hot", 1)
+	c.Set("cold", 2)
+	for i := 0; i < 3; i++ {
+		c.GetNoPromote("hot")
+	}
+	c.GetNoPromote("cold")
+
+	// LRU would evict "hot", the tail of segment 0
+	c.Set("new", 3)
+
+	if _, ok := c.Peek("hot"); !ok {
+		t.Errorf("frequently accessed item was evicted")
+	}
+	if _, ok := c.Peek("cold"); ok {
+		t.Errorf("rarely accessed item survived")
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	// by default the tail goes
+	c = New(8)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+	if _, ok := c.Peek("a"); ok {
+		t.Errorf("default selection didn't evict the LRU item")
+	}
+}
+
+func TestVictimSelectorPaths(t *testing.T) {
+
+	// always protect "keep", whatever its position
+	protect := func(keys []string) string {
+		for _, k := range keys {
+			if k != "keep" {
+				return k
+			}
+		}
+		return keys[0]
+	}
+
+	for name, insert := range map[string]func(c *Cache, key string){
+		"Set":            func(c *Cache, key string) { c.Set(key, 0) },
+		"SetKeepSegment": func(c *Cache, key string) { c.SetKeepSegment(key, 0) },
+		"SetWithSegment": func(c *Cache, key string) { c.SetWithSegment(key, 0, 0) },
+		"SetWithSegment above 0": func(c *Cache, key string) {
+			c.SetWithSegment(key, 0, 1) // displaces segment 1's tail into segment 0
+		},
+	} {
+		c := New(8, WithVictimSelector(protect))
+		c.Set("keep", 0)
+		c.SetWithSegment("s1a", 0, 1)
+		c.SetWithSegment("s1b", 0, 1)
+		for i := 0; i < 6; i++ {
+			insert(c, strconv.Itoa(i))
+		}
+		if _, ok := c.Peek("keep"); !ok {
+			t.Errorf("%s: the selector's protected key was evicted", name)
+		}
+		if err := c.checkInvariants(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// a ghost readmission displaces into segment 0 too
+	c := New(8, WithVictimSelector(protect), WithGhost(8))
+	c.Set("keep", 0)
+	c.Set("g", 0)
+	c.Set("x", 0) // evicts g into the ghost list
+	c.SetWithSegment("s1a", 0, 1)
+	c.SetWithSegment("s1b", 0, 1)
+	c.Set("g", 0) // readmitted to segment 1, demoting s1b
+	if _, ok := c.Peek("keep"); !ok {
+		t.Errorf("ghost readmission: the selector's protected key was evicted")
+	}
+
+	// choosing a victim reuses its buffer
+	c = New(64, WithVictimSelector(func(keys []string) string { return keys[0] }))
+	for i := 0; i < 16; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	if n := testing.AllocsPerRun(100, func() { c.selectVictim() }); n != 0 {
+		t.Errorf("selectVictim made %v allocations, want 0", n)
+	}
+}
+
+func TestSwapPositions(t *testing.T) {
+
+	c := New(8)
+
+	c.Set("hot", "hot!")
+	c.SetWithSegment("hot", "hot!", 3)
+	c.Set("x", 1)
+	c.Set("cold", "cold!")
+
+	if !c.SwapPositions("cold", "hot") {
+		t.Fatalf("SwapPositions failed for present keys")
+	}
+
+	if seg := c.items[c.data["cold"]].lidx; seg != 3 {
+		t.Errorf("cold in segment %d after swap, want 3", seg)
+	}
+	if seg := c.items[c.data["hot"]].lidx; seg != 0 {
+		t.Errorf("hot in segment %d after swap, want 0", seg)
+	}
+	// hot took cold's place at the front of segment 0
+	if got := segmentKeys(c, 0); len(got) != 2 || got[0] != "hot" || got[1] != "x" {
+		t.Errorf("segment 0 is %v, want [hot x]", got)
+	}
+	if v, _ := c.Peek("hot"); v != "hot!" {
+		t.Errorf("hot has value %v after swap, want hot!", v)
+	}
+	if v, _ := c.Peek("cold"); v != "cold!" {
+		t.Errorf("cold has value %v after swap, want cold!", v)
+	}
+
+	if c.SwapPositions("hot", "missing") || c.SwapPositions("missing", "hot") {
+		t.Errorf("SwapPositions succeeded with a missing key")
+	}
+
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRemoveMulti(t *testing.T) {
+
+	c := New(16)
+
+	var fired []string
+	c.OnRemove = func(key string, value interface{}) { fired = append(fired, key) }
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+
+	want := []string{"a", "c"}
+	if got := c.RemoveMulti([]string{"a", "missing", "c", "a"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("RemoveMulti()=%v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(fired, want) {
+		t.Errorf("OnRemove called for %v, want %v", fired, want)
+	}
+	if c.Len() != 1 {
+		t.Errorf("Len()=%d after RemoveMulti, want 1", c.Len())
+	}
+	if got := c.RemoveMulti([]string{"x", "y"}); len(got) != 0 {
+		t.Errorf("RemoveMulti of absent keys returned %v", got)
+	}
+}
+
+func TestSetKeepSegment(t *testing.T) {
+
+	c := New(8)
+
+	c.Set("a", 1)
+	c.Get("a")
+	c.Set("b", 2)
+	c.Get("b")
+
+	c.SetKeepSegment("b", 20)
+
+	if got := segmentKeys(c, 1); !reflect.DeepEqual(got, []string{"b", "a"}) {
+		t.Errorf("segment 1 is %v after SetKeepSegment, want [b a]", got)
+	}
+	c.SetKeepSegment("a", 10)
+	if got := segmentKeys(c, 1); !reflect.DeepEqual(got, []string{"b", "a"}) {
+		t.Errorf("segment 1 is %v after SetKeepSegment, want [b a]", got)
+	}
+	if v, _ := c.Peek("a"); v != 10 {
+		t.Errorf("a=%v after SetKeepSegment, want 10", v)
+	}
+
+	c.SetKeepSegment("new", 3)
+	if seg := c.items[c.data["new"]].lidx; seg != 0 {
+		t.Errorf("new key inserted into segment %d, want 0", seg)
+	}
+}
+
+func TestPromoteOnSet(t *testing.T) {
+
+	for _, tt := range []struct {
+		name string
+		opts []Option
+		want int
+	}{
+		{"default", nil, 1},
+		{"WithPromoteOnSet(true)", []Option{WithPromoteOnSet(true)}, 1},
+		{"WithPromoteOnSet(false)", []Option{WithPromoteOnSet(false)}, 0},
+	} {
+		c := New(8, tt.opts...)
+		c.Set("a", 1)
+		c.Set("a", 2)
+		if seg := c.items[c.data["a"]].lidx; seg != tt.want {
+			t.Errorf("%s: a in segment %d after a second Set, want %d", tt.name, seg, tt.want)
+		}
+		if v, _ := c.Peek("a"); v != 2 {
+			t.Errorf("%s: a=%v after a second Set, want 2", tt.name, v)
+		}
+	}
+}
+
+func TestGetTransition(t *testing.T) {
+
+	c := New(8)
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	type transition struct {
+		key      string
+		from, to int
+	}
+
+	for _, tt := range []transition{
+		{"a", 0, 1},
+		{"b", 0, 1},
+		{"a", 1, 2},
+		{"a", 2, 3},
+		{"a", 3, 3},
+		{"b", 1, 2},
+		{"missing", -1, -1},
+	} {
+		v, from, to, ok := c.GetTransition(tt.key)
+		if ok != (tt.key != "missing") {
+			t.Errorf("GetTransition(%q): ok=%v", tt.key, ok)
+		}
+		if ok && v != c.items[c.data[tt.key]].value {
+			t.Errorf("GetTransition(%q) returned value %v", tt.key, v)
+		}
+		if from != tt.from || to != tt.to {
+			t.Errorf("GetTransition(%q) moved %d->%d, want %d->%d", tt.key, from, to, tt.from, tt.to)
+		}
+	}
+
+	// the swap path: c is promoted into the full segment 1
+	c = New(8)
+	for _, k := range []string{"x", "y"} {
+		c.Set(k, 0)
+		c.Get(k)
+	}
+	c.Set("c", 0)
+	if _, from, to, _ := c.GetTransition("c"); from != 0 || to != 1 {
+		t.Errorf("GetTransition(c) on the swap path moved %d->%d, want 0->1", from, to)
+	}
+}
+
+func TestNewWithHint(t *testing.T) {
+
+	for _, hint := range []int{-1, 0, 5, 100} {
+		c := NewWithHint(16, hint)
+		for i := 0; i < 64; i++ {
+			c.Set(strconv.Itoa(i), i)
+			c.Get(strconv.Itoa(i / 2))
+		}
+		if c.Capacity() != 16 || c.Len() > 16 {
+			t.Errorf("NewWithHint(16, %d): Capacity()=%d, Len()=%d", hint, c.Capacity(), c.Len())
+		}
+		if err := c.checkInvariants(); err != nil {
+			t.Errorf("NewWithHint(16, %d): %v", hint, err)
+		}
+	}
+}
+
+func TestNewE(t *testing.T) {
+
+	if _, err := NewE(0); err != ErrNoCapacity {
+		t.Errorf("NewE(0): err=%v, want ErrNoCapacity", err)
+	}
+	if _, err := NewE(-1); err == nil {
+		t.Errorf("NewE(-1) succeeded")
+	}
+	if c, err := NewE(1); err != nil || c.Capacity() != 1 {
+		t.Errorf("NewE(1)=(%v,%v), want a cache of capacity 1", c, err)
+	}
+
+	for _, caps := range [][]int{nil, {0, 0, 0, 0}, {0, 4}, {1, -1}} {
+		if _, err := NewWithSegmentsE(caps); err == nil {
+			t.Errorf("NewWithSegmentsE(%v) succeeded", caps)
+		}
+	}
+	if _, err := NewWithSegmentsE([]int{0, 0, 0, 0}); err != ErrNoCapacity {
+		t.Errorf("NewWithSegmentsE(all zero): err=%v, want ErrNoCapacity", err)
+	}
+	if c, err := NewWithSegmentsE([]int{2, 0, 1}); err != nil || c.Capacity() != 3 {
+		t.Errorf("NewWithSegmentsE([2 0 1])=(%v,%v), want a cache of capacity 3", c, err)
+	}
+
+	// the panicking constructors still accept an empty cache, which stores
+	// nothing
+	c := NewWithSegments([]int{0, 0, 0, 0})
+	c.Set("a", 1)
+	if _, ok := c.Get("a"); ok || c.Len() != 0 {
+		t.Errorf("a cache with no capacity stored an item")
+	}
+}
+
+// TestSetDuplicateKey reproduces the corruption where Set on a key that had
+// been promoted linked a second item for it, leaving the key in two segments
+func TestSetDuplicateKey(t *testing.T) {
+
+	c := New(8)
+
+	c.Set("k", "v1")
+	c.Get("k")
+	c.Get("k")
+	c.Set("k", "v2")
+
+	if n := c.Len(); n != 1 {
+		t.Errorf("Len()=%d, want 1", n)
+	}
+	if v, ok := c.Get("k"); !ok || v != "v2" {
+		t.Errorf("Get(k)=(%v,%v), want (v2,true)", v, ok)
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSoftLimit(t *testing.T) {
+
+	c := New(8, WithSoftLimit(12))
+
+	for i := 0; i < 6; i++ {
+		c.SetWithSegment("top"+strconv.Itoa(i), i, 1+i%3)
+	}
+
+	// a burst of inserts is absorbed up to the soft limit
+	for i := 0; i < 6; i++ {
+		c.Set("burst"+strconv.Itoa(i), i)
+	}
+	if n := c.Len(); n != 12 {
+		t.Errorf("Len()=%d after a burst, want 12", n)
+	}
+	for i := 0; i < 6; i++ {
+		if _, ok := c.Peek("burst" + strconv.Itoa(i)); !ok {
+			t.Errorf("burst%d was evicted during the burst", i)
+		}
+	}
+
+	// past the soft limit Set evicts as usual
+	c.Set("more", 0)
+	if n := c.Len(); n != 12 {
+		t.Errorf("Len()=%d past the soft limit, want 12", n)
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	// reads drain the excess a few items at a time
+	c.Get("top0")
+	if n := c.Len(); n != 10 {
+		t.Errorf("Len()=%d after one read, want 10", n)
+	}
+	c.Get("top0")
+	c.Get("top0")
+	if n := c.Len(); n != 8 {
+		t.Errorf("Len()=%d after draining, want 8", n)
+	}
+	if _, ok := c.Peek("more"); !ok {
+		t.Errorf("draining evicted the most recent insert")
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetEStats(t *testing.T) {
+
+	clock := &fakeClock{t: time.Unix(0, 0)}
+
+	var logged []string
+	c := New(8, WithStats(true))
+	c.Now = clock.Now
+	c.Logger = func(format string, args ...interface{}) { logged = append(logged, fmt.Sprintf(format, args...)) }
+
+	c.GetE("missing")
+	c.SetWithTTL("k", 1, time.Second)
+	c.GetE("k")
+	clock.Advance(2 * time.Second)
+	if _, err := c.GetE("k"); err != ErrExpired {
+		t.Errorf("GetE(k) after its TTL: err=%v, want ErrExpired", err)
+	}
+
+	if st := c.Stats(); st.Hits != 1 || st.Misses != 2 {
+		t.Errorf("Stats()=%+v, want 1 hit and 2 misses", st)
+	}
+	if last := logged[len(logged)-1]; last != `expire "k" segment=1` {
+		t.Errorf("last log line %q, want the expiry", last)
+	}
+}
+
+func TestGetENotExpired(t *testing.T) {
+
+	// a key drained under the soft limit by the lookup itself
+	c := New(4, WithSoftLimit(8))
+	for i := 0; i < 5; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	if _, err := c.GetE("0"); err != ErrNotFound {
+		t.Errorf("GetE of a drained key: err=%v, want ErrNotFound", err)
+	}
+
+	// and a bypassed one
+	c = New(4, WithBypassRate(1))
+	c.Set("k", 1)
+	if _, err := c.GetE("k"); err != ErrNotFound {
+		t.Errorf("GetE of a bypassed key: err=%v, want ErrNotFound", err)
+	}
+}
+
+func TestSoftLimitInsertPaths(t *testing.T) {
+
+	c := New(8, WithSoftLimit(16), WithGhost(64))
+
+	for i := 0; i < 6; i++ {
+		c.SetWithSegment("top"+strconv.Itoa(i), i, 1+i%3)
+	}
+
+	// push "ghost" through segment 0 and out into the ghost list
+	c.Set("ghost", 0)
+	for i := 0; i < 10; i++ {
+		c.Set("burst"+strconv.Itoa(i), i)
+	}
+	if _, ok := c.Peek("ghost"); ok {
+		t.Fatalf("ghost wasn't evicted by the burst")
+	}
+	if n := c.Len(); n != 16 {
+		t.Fatalf("Len()=%d after a burst, want 16", n)
+	}
+
+	// every insert path keeps the excess rather than evicting it at once
+	for name, insert := range map[string]func(){
+		"ghost readmission": func() { c.Set("ghost", 1) },
+		"SetKeepSegment":    func() { c.SetKeepSegment("keep", 1) },
+		"SetWithSegment":    func() { c.SetWithSegment("seg", 1, 2) },
+		"MoveToSegment":     func() { c.MoveToSegment("burst9", 3) },
+	} {
+		insert()
+		if n := c.Len(); n < 15 {
+			t.Errorf("%s: Len()=%d, want the burst kept", name, n)
+		}
+		if err := c.checkInvariants(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// and reads still drain it
+	for i := 0; i < 8; i++ {
+		c.Get("top0")
+	}
+	if n := c.Len(); n != 8 {
+		t.Errorf("Len()=%d after draining, want 8", n)
+	}
+}
+
+func TestEmptyKey(t *testing.T) {
+
+	c := New(8)
+
+	if c.Contains("") {
+		t.Fatalf("empty cache contains the empty key")
+	}
+
+	c.Set("", "empty")
+	c.Set("a", "a")
+
+	if !c.Contains("") {
+		t.Errorf("Contains(\"\")=false after Set")
+	}
+	if v, ok := c.Get(""); !ok || v != "empty" {
+		t.Errorf("Get(\"\")=(%v,%v), want (empty,true)", v, ok)
+	}
+	if c.items[c.slot("")].lidx != 1 {
+		t.Errorf("empty key wasn't promoted by Get")
+	}
+
+	if v, ok := c.Remove(""); !ok || v != "empty" {
+		t.Errorf("Remove(\"\")=(%v,%v), want (empty,true)", v, ok)
+	}
+	if c.Contains("") {
+		t.Errorf("Contains(\"\")=true after Remove")
+	}
+	if _, ok := c.Get(""); ok {
+		t.Errorf("Get(\"\") found a removed key")
+	}
+	if !c.Contains("a") || c.Len() != 1 {
+		t.Errorf("removing the empty key disturbed the others")
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEvictionBatch(t *testing.T) {
+
+	c := New(16, WithEvictionBatch(3)) // 4 per segment
+
+	for i := 0; i < 4; i++ {
+		c.Set("k"+strconv.Itoa(i), i)
+	}
+
+	// the first insert into the full segment evicts the three coldest
+	c.Set("k4", 4)
+	if got := c.EvictionOrder(); !reflect.DeepEqual(got, []string{"k3", "k4"}) {
+		t.Fatalf("after the first batch: EvictionOrder()=%v, want [k3 k4]", got)
+	}
+
+	// and the next two inserts evict nothing
+	c.Set("k5", 5)
+	c.Set("k6", 6)
+	if n := c.lists[0].Len(); n != 4 {
+		t.Errorf("segment 0 holds %d, want 4", n)
+	}
+	if _, ok := c.Peek("k3"); !ok {
+		t.Errorf("k3 was evicted before segment 0 filled up again")
+	}
+
+	c.Set("k7", 7)
+	if got := c.EvictionOrder(); !reflect.DeepEqual(got, []string{"k6", "k7"}) {
+		t.Errorf("after the second batch: EvictionOrder()=%v, want [k6 k7]", got)
+	}
+
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBeforeSetEvict(t *testing.T) {
+
+	c := New(8) // 2 per segment
+	c.Set("pinned", 1)
+	c.Set("b", 2)
+
+	c.BeforeSetEvict = func(key string, value interface{}) bool {
+		return key != "pinned"
+	}
+
+	// pinned is the tail, so b goes instead
+	c.Set("c", 3)
+	if _, ok := c.Peek("pinned"); !ok {
+		t.Errorf("protected key was evicted")
+	}
+	if _, ok := c.Peek("b"); ok {
+		t.Errorf("b survived although it was the next coldest")
+	}
+
+	// with everything protected, the Set is dropped
+	c.BeforeSetEvict = func(key string, value interface{}) bool { return false }
+	c.Set("d", 4)
+	if _, ok := c.Peek("d"); ok {
+		t.Errorf("stored d although nothing was evictable")
+	}
+	if got := c.EvictionOrder(); !reflect.DeepEqual(got, []string{"pinned", "c"}) {
+		t.Errorf("EvictionOrder()=%v, want [pinned c]", got)
+	}
+
+	// updates don't evict, so aren't affected
+	c.Set("c", 5)
+	if v, _ := c.Peek("c"); v != 5 {
+		t.Errorf("update of c was dropped")
+	}
+
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewWithTTL(t *testing.T) {
+
+	clock := &fakeClock{t: time.Unix(0, 0)}
+
+	c := NewWithTTL(16, time.Minute)
+	c.Now = clock.Now
+
+	c.Set("default", 1)
+	c.SetKeepSegment("keep", 2)
+	c.SetWithSegment("seg", 3, 2)
+	c.SetWithTTL("long", 4, time.Hour)
+	c.SetWithTTL("short", 5, time.Second)
+
+	clock.Advance(time.Second)
+	if _, ok := c.Get("short"); ok {
+		t.Errorf("per-call TTL shorter than the default wasn't applied")
+	}
+	if _, ok := c.Get("default"); !ok {
+		t.Errorf("default TTL item expired early")
+	}
+
+	clock.Advance(time.Minute)
+	for _, key := range []string{"default", "keep", "seg"} {
+		if _, ok := c.Get(key); ok {
+			t.Errorf("%s outlived the default TTL", key)
+		}
+	}
+	if _, ok := c.Get("long"); !ok {
+		t.Errorf("per-call TTL longer than the default wasn't applied")
+	}
+
+	// updating a key restarts its default TTL
+	c.Set("long", 6)
+	clock.Advance(59 * time.Second)
+	if _, ok := c.Get("long"); !ok {
+		t.Errorf("updated item expired before the default TTL")
+	}
+	clock.Advance(time.Second)
+	if _, ok := c.Get("long"); ok {
+		t.Errorf("updated item kept its per-call TTL instead of the default")
+	}
+
+	if c.Len() != 0 {
+		t.Errorf("Len()=%d after everything expired, want 0", c.Len())
+	}
+}
+
+func TestSegmentOnInsert(t *testing.T) {
+
+	c := New(16)
+	c.SegmentOnInsert = func(key string, value interface{}) int {
+		switch {
+		case strings.HasPrefix(key, "important"):
+			return 2
+		case key == "high":
+			return 99
+		case key == "low":
+			return -1
+		}
+		return 0
+	}
+
+	c.Set("plain", 1)
+	c.Set("important1", 2)
+	c.SetKeepSegment("important2", 3)
+	c.Set("high", 4)
+	c.Set("low", 5)
+
+	for key, want := range map[string]int{
+		"plain":      0,
+		"important1": 2,
+		"important2": 2,
+		"high":       3,
+		"low":        0,
+	} {
+		if seg := c.items[c.slot(key)].lidx; seg != want {
+			t.Errorf("%s entered segment %d, want %d", key, seg, want)
+		}
+	}
+
+	// updates aren't re-placed
+	c.Set("important1", 6)
+	if seg := c.items[c.slot("important1")].lidx; seg != 3 {
+		t.Errorf("updated key in segment %d, want it promoted to 3", seg)
+	}
+
+	// overfilling segment 2 cascades its tail down
+	for i := 3; i < 8; i++ {
+		c.Set("important"+strconv.Itoa(i), i)
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+	if n := c.lists[2].Len(); n != 4 {
+		t.Errorf("segment 2 holds %d, want 4", n)
+	}
+}
+
+func TestTrySet(t *testing.T) {
+
+	for name, c := range map[string]*Cache{
+		"New(0)":          New(0),
+		"segment 0 empty": NewWithSegments([]int{0, 2}),
+		"NewWithCost(0)":  NewWithCost(0, lenCost),
+	} {
+		if err := c.TrySet("k", "v"); !errors.Is(err, ErrNoCapacity) {
+			t.Errorf("%s: TrySet err=%v, want ErrNoCapacity", name, err)
+		}
+		if c.Len() != 0 {
+			t.Errorf("%s: Len()=%d after a failed TrySet", name, c.Len())
+		}
+	}
+
+	c := New(8)
+	if err := c.TrySet("k", "v"); err != nil {
+		t.Errorf("TrySet on a working cache: %v", err)
+	}
+	if v, ok := c.Get("k"); !ok || v != "v" {
+		t.Errorf("Get after TrySet=(%v,%v)", v, ok)
+	}
+
+	// an item placed above the empty segment 0 can still be updated
+	c = NewWithSegments([]int{0, 2})
+	c.SetWithSegment("k", 1, 1)
+	if err := c.TrySet("k", 2); err != nil {
+		t.Errorf("TrySet update: %v", err)
+	}
+}
+
+func TestWouldAdmit(t *testing.T) {
+
+	c := New(8, WithGhost(4)) // 2 per segment
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3) // evicts a into the ghost list
+	if !c.WouldAdmit("cold") || !c.WouldAdmit("a") || !c.WouldAdmit("b") {
+		t.Fatalf("with nothing protected, every key should be admitted")
+	}
+
+	// with all of segment 0 protected, a one-hit wonder has nowhere to go,
+	// but the recently evicted key skips segment 0
+	c.BeforeSetEvict = func(key string, value interface{}) bool { return false }
+	if c.WouldAdmit("cold") {
+		t.Errorf("WouldAdmit(cold)=true with segment 0 protected")
+	}
+	if !c.WouldAdmit("a") {
+		t.Errorf("WouldAdmit(a)=false for a key in the ghost list")
+	}
+	if !c.WouldAdmit("b") {
+		t.Errorf("WouldAdmit(b)=false for a key already present")
+	}
+	if got := c.EvictionOrder(); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("WouldAdmit changed the cache: %v", got)
+	}
+
+	// and Set agrees
+	c.Set("cold", 0)
+	c.Set("a", 1)
+	if c.Contains("cold") || !c.Contains("a") {
+		t.Errorf("Set disagreed with WouldAdmit: cold=%v a=%v", c.Contains("cold"), c.Contains("a"))
+	}
+
+	for name, c := range map[string]*Cache{
+		"New(0)":        New(0),
+		"WithMaxKeyLen": New(8, WithMaxKeyLen(2, RejectLongKeys)),
+	} {
+		if c.WouldAdmit("cold") {
+			t.Errorf("%s: WouldAdmit(cold)=true", name)
+		}
+	}
+}
+
+func TestOverheadBytes(t *testing.T) {
+
+	c := New(64)
+	if n := c.OverheadBytes(); n != 0 {
+		t.Errorf("OverheadBytes() of an empty cache = %d, want 0", n)
+	}
+
+	c.Set("a", 1)
+	per := c.OverheadBytes()
+	if per < 64 {
+		t.Errorf("OverheadBytes() for one item = %d, want at least the 64 byte slot", per)
+	}
+
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	if n := c.OverheadBytes(); n != int64(c.Len())*per {
+		t.Errorf("OverheadBytes()=%d for %d items, want %d", n, c.Len(), int64(c.Len())*per)
+	}
+}
+
+func TestGetRef(t *testing.T) {
+
+	c := New(8) // 2 per segment
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3) // evicts a
+	c.Set("a", 1) // evicts b; segment 0 is now [a c]
+
+	c.SetWithSegment("hot", 0, 3)
+	v, release, ok := c.GetRef("hot")
+	if !ok || v != 0 {
+		t.Fatalf("GetRef(hot)=(%v,%v)", v, ok)
+	}
+	c.Remove("hot")
+	release() // after removal: a no-op
+	if c.inUse != 0 {
+		t.Fatalf("%d items in use after the only one was removed", c.inUse)
+	}
+
+	_, release, _ = c.GetRef("c") // promotes c to segment 1
+	c.MoveToSegment("c", 0)       // and back, to the front: [c a]
+	c.MoveToSegment("a", 0)       // [a c], c is the tail
+	c.Set("d", 4)
+	if !c.Contains("c") {
+		t.Fatalf("in-use item was evicted")
+	}
+	if c.Contains("a") {
+		t.Errorf("a survived although it was the coldest free item")
+	}
+
+	// with all of segment 0 in use, new keys are turned away
+	_, releaseD, _ := c.GetRef("d")
+	c.MoveToSegment("d", 0)
+	c.Set("e", 5)
+	if c.Contains("e") {
+		t.Errorf("stored e although every item in segment 0 was in use")
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	release()
+	release() // twice does nothing
+	releaseD()
+	if c.inUse != 0 {
+		t.Errorf("%d items in use after releasing everything", c.inUse)
+	}
+	c.Set("e", 5)
+	if !c.Contains("e") || c.Contains("c") {
+		t.Errorf("released item wasn't evictable again")
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSegmentKeys(t *testing.T) {
+
+	c := New(8) // 2 per segment
+	c.Set("a", nil)
+	c.Set("b", nil)
+	for _, key := range []string{"a", "a", "a", "b", "b", "b"} {
+		c.Get(key)
+	}
+	c.Set("c", nil)
+	for _, key := range []string{"c", "c", "c", "b"} {
+		c.Get(key)
+	}
+
+	// c's arrival in the full top segment swapped a, its tail, down
+	if got, want := c.TopSegmentKeys(), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("TopSegmentKeys()=%v, want %v", got, want)
+	}
+	if got := c.ProtectedLen(); got != 2 {
+		t.Errorf("ProtectedLen()=%d, want 2", got)
+	}
+	if got := c.SegmentKeys(2); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("SegmentKeys(2)=%v, want [a]", got)
+	}
+	if got := c.SegmentKeys(0); len(got) != 0 {
+		t.Errorf("SegmentKeys(0)=%v, want none", got)
+	}
+}
+
+func TestOnInsert(t *testing.T) {
+
+	c := New(8) // 2 per segment
+
+	var events []string
+	c.OnInsert = func(key string, value interface{}) { events = append(events, "insert "+key) }
+	c.OnEvict = func(key string, value interface{}) { events = append(events, "evict "+key) }
+	c.OnRemove = func(key string, value interface{}) { events = append(events, "remove "+key) }
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("a", 3) // an update, not an insert
+	c.Set("c", 4)
+	c.Set("d", 5) // evicts b
+	c.Remove("a")
+	c.SetWithSegment("e", 6, 2)
+	c.WarmHot([]Entry{{Key: "f", Value: 7}})
+
+	want := []string{
+		"insert a", "insert b", "insert c",
+		"evict b", "insert d",
+		"remove a",
+		"insert e", "insert f",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events %v, want %v", events, want)
+	}
+}
+
+func TestGetOrDefault(t *testing.T) {
+
+	c := New(8)
+	c.Set("a", 1)
+
+	if v := c.GetOrDefault("a", 0); v != 1 {
+		t.Errorf("GetOrDefault(a)=%v, want 1", v)
+	}
+	if seg := c.items[c.slot("a")].lidx; seg != 1 {
+		t.Errorf("a in segment %d after GetOrDefault, want it promoted to 1", seg)
+	}
+	if v := c.GetOrDefault("b", "def"); v != "def" {
+		t.Errorf("GetOrDefault(b)=%v, want def", v)
+	}
+	if c.Contains("b") || c.Len() != 1 {
+		t.Errorf("GetOrDefault stored the default")
+	}
+}
+
+func TestGetAndModify(t *testing.T) {
+
+	c := New(8)
+	c.SetWithTTL("n", 0, time.Hour)
+
+	incr := func(v interface{}) interface{} { return v.(int) + 1 }
+	for i := 1; i <= 10; i++ {
+		if v, ok := c.GetAndModify("n", incr); !ok || v != i {
+			t.Fatalf("GetAndModify %d: got %v %v, want %d true", i, v, ok, i)
+		}
+	}
+	if v, _ := c.Peek("n"); v != 10 {
+		t.Errorf("stored value %v, want 10", v)
+	}
+	if seg := c.items[c.slot("n")].lidx; seg != 3 {
+		t.Errorf("n in segment %d after GetAndModify, want it promoted to 3", seg)
+	}
+	if x := c.items[c.slot("n")].extra; x == nil || x.ttl != time.Hour {
+		t.Errorf("GetAndModify dropped the TTL")
+	}
+
+	called := false
+	if _, ok := c.GetAndModify("missing", func(v interface{}) interface{} { called = true; return v }); ok || called {
+		t.Errorf("GetAndModify of a missing key: ok=%v, fn called=%v", ok, called)
+	}
+	if c.Contains("missing") {
+		t.Errorf("GetAndModify stored a missing key")
+	}
+}
+
+func TestBypassRate(t *testing.T) {
+
+	for _, tt := range []struct {
+		rate     float64
+		min, max int
+	}{
+		{0, 100, 100},
+		{0.5, 30, 70},
+		{1, 0, 0},
+	} {
+		c := New(400, WithBypassRate(tt.rate))
+		for i := 0; i < 100; i++ {
+			c.Set(strconv.Itoa(i), i)
+		}
+
+		hits := 0
+		for i := 0; i < 100; i++ {
+			key := strconv.Itoa(i)
+			_, ok := c.Get(key)
+			if ok {
+				hits++
+			}
+			if _, again := c.Get(key); again != ok {
+				t.Errorf("rate %v: key %s bypassed on one Get but not the next", tt.rate, key)
+			}
+		}
+		if hits < tt.min || hits > tt.max {
+			t.Errorf("rate %v: %d of 100 Gets hit, want %d to %d", tt.rate, hits, tt.min, tt.max)
+		}
+		if c.Len() != 100 {
+			t.Errorf("rate %v: bypassed Gets dropped items, Len()=%d", tt.rate, c.Len())
+		}
+	}
+}
+
+func TestAdmissionOrder(t *testing.T) {
+
+	// LIFO: the newest cold key goes first
+	c := New(8, WithAdmissionOrder(LIFO)) // 2 per segment
+	c.Set("a", nil)
+	c.Set("b", nil)
+	c.Set("c", nil)
+	if got := c.SegmentKeys(0); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("LIFO segment 0 = %v, want [a c]", got)
+	}
+	c.Get("c") // promoted, making room
+	c.Set("d", nil)
+	c.Set("e", nil)
+	if got := c.SegmentKeys(0); !reflect.DeepEqual(got, []string{"a", "e"}) {
+		t.Errorf("LIFO segment 0 = %v, want [a e]", got)
+	}
+
+	// cost mode takes the same path through insertAt
+	cc := NewWithCost(40, lenCost, WithAdmissionOrder(LIFO))
+	for _, key := range []string{"a", "b", "c"} {
+		cc.Set(key, "xxxx")
+	}
+	if got := cc.SegmentKeys(0); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("LIFO cost-mode segment 0 = %v, want [a c]", got)
+	}
+
+	// FIFO: a read that can't promote doesn't save an item
+	for order, victim := range map[Order]string{LRU: "b", FIFO: "a"} {
+		c := New(3, WithAdmissionOrder(order)) // a single segment
+		c.Set("a", nil)
+		c.Set("b", nil)
+		c.Set("c", nil)
+		c.Get("a")
+		c.Set("d", nil)
+		if c.Contains(victim) {
+			t.Errorf("order %d: %s survived, want it evicted", order, victim)
+		}
+	}
+}
+
+func TestFIFOEvictionOrder(t *testing.T) {
+
+	var evicted []string
+	onEvict := func(key string, value interface{}) { evicted = append(evicted, key) }
+
+	// a plain FIFO cache: nothing but insertion order matters
+	c := NewWithSegments([]int{4}, WithAdmissionOrder(FIFO))
+	c.OnEvict = onEvict
+	for _, key := range []string{"a", "b", "c", "d"} {
+		c.Set(key, nil)
+	}
+	for _, key := range []string{"a", "d", "a", "b", "c"} {
+		c.Get(key)
+	}
+	c.Set("a", 1) // an update isn't an insertion
+	for _, key := range []string{"e", "f", "g", "h"} {
+		c.Set(key, nil)
+	}
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("plain FIFO evicted %v, want %v", evicted, want)
+	}
+
+	// in S4LRU segments, segment 0 goes in order of arrival, demoted items
+	// arriving when they are demoted
+	evicted = nil
+	c = New(8, WithAdmissionOrder(FIFO)) // 2 per segment
+	c.OnEvict = onEvict
+	c.Set("a", nil)
+	c.Get("a")
+	c.Set("b", nil)
+	c.Get("b") // a and b fill segment 1
+	c.Set("c", nil)
+	c.Get("c") // c swaps with a, which arrives in segment 0
+	c.Set("d", nil)
+	c.GetNoPromote("a")
+	c.Set("e", nil)
+	c.Set("f", nil)
+	if want := []string{"a", "d"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("FIFO segment 0 evicted %v, want %v", evicted, want)
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFIFOAdmission(t *testing.T) {
+
+	var evicted []string
+	onEvict := func(key string, value interface{}) { evicted = append(evicted, key) }
+
+	// in a single segment, reads and updates don't reorder anything
+	c := NewWithSegments([]int{4}, WithFIFOAdmission())
+	c.OnEvict = onEvict
+	for _, key := range []string{"a", "b", "c", "d"} {
+		c.Set(key, nil)
+	}
+	for _, key := range []string{"a", "d", "a", "b", "c"} {
+		c.Get(key)
+	}
+	c.Set("a", 1)
+	for _, key := range []string{"e", "f", "g", "h"} {
+		c.Set(key, nil)
+	}
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("single segment evicted %v, want %v", evicted, want)
+	}
+
+	// a demoted item keeps the age it had when first inserted
+	evicted = nil
+	c = New(8, WithFIFOAdmission()) // 2 per segment
+	c.OnEvict = onEvict
+	c.Set("a", nil)
+	c.Get("a")
+	c.Set("b", nil)
+	c.Get("b") // a and b fill segment 1
+	c.Set("d", nil)
+	c.Set("c", nil)
+	c.Get("c") // c swaps with a, which joins segment 0 ahead of d
+	c.Set("e", nil)
+	c.Set("f", nil)
+	if want := []string{"a", "d"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("segment 0 evicted %v, want %v", evicted, want)
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnboundedCompact(t *testing.T) {
+
+	c := New(16) // 4 per segment
+	c.SetUnbounded(true)
+
+	for i := 0; i < 100; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	for r := 0; r < 3; r++ {
+		for i := 0; i < 8; i++ {
+			c.Get(strconv.Itoa(i * 10))
+		}
+	}
+	if c.Len() != 100 {
+		t.Fatalf("Len()=%d while unbounded, want all 100 kept", c.Len())
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+
+	evicted := 0
+	c.OnEvict = func(string, interface{}) { evicted++ }
+	c.Compact(16)
+
+	if c.Len() != 16 || evicted != 84 {
+		t.Errorf("after Compact(16): Len()=%d, %d evicted; want 16 and 84", c.Len(), evicted)
+	}
+	for i := 0; i < 8; i++ {
+		if !c.Contains(strconv.Itoa(i * 10)) {
+			t.Errorf("hot key %d didn't survive Compact", i*10)
+		}
+	}
+	for i := 92; i < 100; i++ {
+		if !c.Contains(strconv.Itoa(i)) {
+			t.Errorf("recent key %d didn't survive Compact", i)
+		}
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	// bounded again: new keys evict
+	c.Set("new", nil)
+	if c.Len() != 16 {
+		t.Errorf("Len()=%d after Compact and a Set, want 16", c.Len())
+	}
+
+	// turning unbounded mode off compacts to the capacity it had
+	c.SetUnbounded(true)
+	for i := 0; i < 10; i++ {
+		c.Set("more"+strconv.Itoa(i), nil)
+	}
+	c.SetUnbounded(false)
+	if c.Len() != 16 {
+		t.Errorf("Len()=%d after SetUnbounded(false), want 16", c.Len())
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnboundedReshape(t *testing.T) {
+
+	c := New(8, WithStats(true))
+	c.SetUnbounded(true)
+	for n := 0; n < 20; n++ {
+		c.Set(strconv.Itoa(n), n)
+		for r := 0; r < 3; r++ {
+			c.Get(strconv.Itoa(n))
+		}
+	}
+
+	// the upper segments are overfull, but unbounded Reshape evicts nothing
+	c.Reshape(2)
+	if c.Len() != 20 || c.Stats().Evictions != 0 {
+		t.Errorf("unbounded Reshape: Len()=%d, %d evictions, want 20 and 0", c.Len(), c.Stats().Evictions)
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	c.SetUnbounded(false)
+	if c.Len() != 8 {
+		t.Errorf("Len()=%d after SetUnbounded(false), want 8", c.Len())
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompactKeepsCaps(t *testing.T) {
+
+	c := NewWithSegments([]int{10, 1, 1, 0})
+	c.SetUnbounded(true)
+	for n := 0; n < 30; n++ {
+		c.Set(strconv.Itoa(n), n)
+		c.Get(strconv.Itoa(n % 4))
+	}
+	c.SetUnbounded(false)
+	if want := []int{10, 1, 1, 0}; !reflect.DeepEqual(c.caps, want) {
+		t.Errorf("caps %v after SetUnbounded(false), want %v", c.caps, want)
+	}
+	if c.Len() != 12 {
+		t.Errorf("Len()=%d, want 12", c.Len())
+	}
+
+	// a new capacity scales the caps in proportion
+	c.Compact(6)
+	if want := []int{5, 1, 0, 0}; !reflect.DeepEqual(c.caps, want) {
+		t.Errorf("caps %v after Compact(6), want %v", c.caps, want)
+	}
+	c.Compact(24) // scaling the current caps, not the original ones
+	if want := []int{20, 4, 0, 0}; !reflect.DeepEqual(c.caps, want) {
+		t.Errorf("caps %v after Compact(24), want %v", c.caps, want)
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLastSetEvicted(t *testing.T) {
+
+	c := New(8) // 2 per segment
+
+	for n, tt := range []struct {
+		set     func()
+		evicted bool
+	}{
+		{func() { c.Set("a", 1) }, false},
+		{func() { c.Set("b", 2) }, false},
+		{func() { c.Set("c", 3) }, true},
+		{func() { c.Set("c", 4) }, false}, // an update
+		{func() { c.SetWithTTL("d", 5, time.Hour) }, false},
+		{func() { c.SetKeepSegment("e", 6) }, true},
+		{func() { c.SetWithSegment("f", 7, 0) }, true},
+	} {
+		tt.set()
+		if got := c.LastSetEvicted(); got != tt.evicted {
+			t.Errorf("Set %d: LastSetEvicted()=%v, want %v", n, got, tt.evicted)
+		}
+	}
+
+	c.Get("f")
+	if !c.LastSetEvicted() {
+		t.Errorf("a Get changed LastSetEvicted")
+	}
+}
+
+func TestMinAdmission(t *testing.T) {
+
+	for _, tt := range []struct {
+		c    *Cache
+		caps []int
+	}{
+		{New(8, WithMinAdmission(5)), []int{5, 1, 1, 1}},
+		{New(4, WithMinAdmission(6)), []int{4, 0, 0, 0}},
+		{NewWithSegments([]int{1, 6, 2, 3}, WithMinAdmission(4)), []int{4, 3, 2, 3}},
+	} {
+		if !reflect.DeepEqual(tt.c.caps, tt.caps) {
+			t.Errorf("caps=%v, want %v", tt.c.caps, tt.caps)
+		}
+	}
+
+	// adaptive resizing never shrinks segment 0 below the floor, however
+	// cold it is
+	c := New(16, WithMinAdmission(3), WithAdaptive(4))
+	r := rand.New(rand.NewSource(0))
+	for n := 0; n < 5000; n++ {
+		k := strconv.Itoa(r.Intn(6))
+		if _, ok := c.Get(k); !ok {
+			c.Set(k, n)
+		}
+		if c.caps[0] < 3 {
+			t.Fatalf("op %d: segment 0 capacity %d below the floor", n, c.caps[0])
+		}
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	c.Reshape(8) // 2 per segment
+	if c.caps[0] != 3 {
+		t.Errorf("after Reshape: segment 0 capacity %d, want 3", c.caps[0])
+	}
+	c.Compact(6)
+	if c.caps[0] != 3 {
+		t.Errorf("after Compact: segment 0 capacity %d, want 3", c.caps[0])
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSwapThrash(t *testing.T) {
+
+	c := thrashCache(4, 4, WithStats(true))
+	want := c.EvictionOrder()
+	sort.Strings(want)
+
+	const gets = 2000
+	for n := 0; n < gets; n++ {
+		key := thrashKey(c, n)
+		seg := c.items[c.data[key]].lidx
+		if _, ok := c.Get(key); !ok {
+			t.Fatalf("Get %d: %q missing", n, key)
+		}
+		if got := c.items[c.data[key]].lidx; got != seg+1 {
+			t.Fatalf("Get %d: %q stuck in segment %d, want %d", n, key, got, seg+1)
+		}
+		if err := c.checkInvariants(); err != nil {
+			t.Fatalf("Get %d: %v", n, err)
+		}
+	}
+
+	// nothing was lost, duplicated or evicted by the swaps
+	got := c.EvictionOrder()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("keys after thrashing: %v, want %v", got, want)
+	}
+	if st := c.Stats(); st.SwapPromotions != gets || st.MovePromotions != 0 || st.Evictions != 0 {
+		t.Errorf("Stats()=%+v, want %d swaps and no moves or evictions", st, gets)
+	}
+
+	if allocs := testing.AllocsPerRun(1000, func() { c.Get(thrashKey(c, 0)) }); allocs != 0 {
+		t.Errorf("swap thrash: %v allocs per Get, want 0", allocs)
+	}
+}
+
+func TestNewFromMap(t *testing.T) {
+
+	data := map[string]interface{}{}
+	for i := 0; i < 8; i++ {
+		data["k"+strconv.Itoa(i)] = i
+	}
+
+	// a map that fits is stored whole, filling the cache from the top
+	c := NewFromMap(8, data)
+	if c.Len() != 8 {
+		t.Errorf("Len()=%d, want 8", c.Len())
+	}
+	for key, value := range data {
+		if v, ok := c.Peek(key); !ok || v != value {
+			t.Errorf("Peek(%s)=(%v,%v), want (%v,true)", key, v, ok, value)
+		}
+	}
+	if got := c.SegmentLens(); !reflect.DeepEqual(got, []int{2, 2, 2, 2}) {
+		t.Errorf("SegmentLens()=%v, want [2 2 2 2]", got)
+	}
+
+	// one that overflows keeps capacity of its entries, whichever they are
+	c = NewFromMap(4, data, WithStats(true))
+	if c.Len() != 4 {
+		t.Errorf("overflowing map: Len()=%d, want 4", c.Len())
+	}
+	for _, key := range c.EvictionOrder() {
+		if v, ok := data[key]; !ok || v != c.items[c.slot(key)].value {
+			t.Errorf("stored %s=%v, not from the map", key, c.items[c.slot(key)].value)
+		}
+	}
+	if st := c.Stats(); st.Evictions != 0 {
+		t.Errorf("seeding evicted %d items, want the excess dropped", st.Evictions)
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	if c := NewFromMap(4, nil); c.Len() != 0 {
+		t.Errorf("NewFromMap(nil) holds %d items", c.Len())
+	}
+}
+
+func TestNewFromEntries(t *testing.T) {
+
+	var entries []Entry
+	for i := 0; i < 6; i++ {
+		entries = append(entries, Entry{Key: "k" + strconv.Itoa(i), Value: i, Segment: 3 - i/2})
+	}
+	entries = append(entries, Entry{Key: "s0", Value: 6}, Entry{Key: "s1", Value: 7}, Entry{Key: "s2", Value: 8})
+
+	// nine hottest-first entries into eight slots: the coldest, last, is
+	// dropped, every time
+	for run := 0; run < 3; run++ {
+		c := NewFromEntries(8, entries)
+		if got, want := c.EvictionOrder(), []string{"s1", "s0", "k5", "k4", "k3", "k2", "k1", "k0"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("run %d: EvictionOrder()=%v, want %v", run, got, want)
+		}
+	}
+
+	// and a Snapshot round-trips
+	c := New(8)
+	for i := 0; i < 20; i++ {
+		c.Set("k"+strconv.Itoa(i%11), i)
+		c.Get("k" + strconv.Itoa(i%3))
+	}
+	if got := NewFromEntries(8, c.Snapshot()).Snapshot(); !reflect.DeepEqual(got, c.Snapshot()) {
+		t.Errorf("NewFromEntries(Snapshot()) gave %v, want %v", got, c.Snapshot())
+	}
+}
+
+func TestPromoteThreshold(t *testing.T) {
+
+	c := New(8, WithPromoteThreshold(3)) // 2 per segment
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	seg := func(key string) int { return c.items[c.slot(key)].lidx }
+
+	// three Gets per segment climbed
+	for want, n := 0, 1; n <= 9; n++ {
+		c.Get("a")
+		if n%3 == 0 {
+			want++
+		}
+		if got := seg("a"); got != want {
+			t.Fatalf("after %d Gets, a in segment %d, want %d", n, got, want)
+		}
+	}
+
+	// the Gets short of the threshold still count as recent use
+	c.Get("b")
+	c.Set("c", 3)
+	if !c.Contains("b") || seg("b") != 0 {
+		t.Errorf("b, read once, wasn't kept at the front of segment 0")
+	}
+	c.Get("c")
+	c.Set("d", 4)
+	if c.Contains("b") {
+		t.Errorf("b survived as the coldest item in segment 0")
+	}
+
+	// and a Set of a key counts toward the threshold too
+	c.Set("c", 3)
+	c.TouchMulti([]string{"c"})
+	if seg("c") != 1 {
+		t.Errorf("c in segment %d after a Get, a Set and a touch, want 1", seg("c"))
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,108 @@
+// Package s4lruhttp serves a JSON summary of an s4lru cache over HTTP, for
+// debugging.  It is kept out of package s4lru so that the cache itself
+// doesn't depend on net/http.
+package s4lruhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/dgryski/go-s4lru"
+)
+
+// Summary is the JSON document served by DebugHandler
+type Summary struct {
+	Capacity int       `json:"capacity"`
+	Len      int       `json:"len"`
+	Segments []Segment `json:"segments"` // from segment 0 up
+	Stats    Stats     `json:"stats"`
+}
+
+// Stats is s4lru.Stats, with JSON names to match the rest of the Summary
+type Stats struct {
+	Hits              uint64  `json:"hits"`
+	Misses            uint64  `json:"misses"`
+	Evictions         uint64  `json:"evictions"`
+	MovePromotions    uint64  `json:"move_promotions"`
+	SwapPromotions    uint64  `json:"swap_promotions"`
+	AvgEvictedSegment float64 `json:"avg_evicted_segment"`
+	MaxEvictedSegment int     `json:"max_evicted_segment"`
+}
+
+// Segment describes one segment of the cache
+type Segment struct {
+	Len  int      `json:"len"`
+	Cap  int      `json:"cap"`
+	Keys []string `json:"keys,omitempty"` // most recently used first
+}
+
+// DebugHandler returns a handler serving a Summary of c.  A request with a
+// keys=N query parameter also lists up to N keys from the front of each
+// segment.  It only reads the cache, promoting and expiring nothing, but
+// like every other use of a Cache it must not run concurrently with one;
+// use LockedDebugHandler for a cache shared between goroutines under a lock.
+func DebugHandler(c *s4lru.Cache) http.Handler {
+	return LockedDebugHandler(c, nil)
+}
+
+// LockedDebugHandler is DebugHandler for a cache guarded by mu, which the
+// handler holds while it reads the cache
+func LockedDebugHandler(c *s4lru.Cache, mu sync.Locker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := 0
+		if v := r.URL.Query().Get("keys"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "keys must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			keys = n
+		}
+
+		if mu != nil {
+			mu.Lock()
+		}
+		s := summarize(c, keys)
+		if mu != nil {
+			mu.Unlock()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	})
+}
+
+// summarize builds the Summary of c, listing up to keys keys per segment
+func summarize(c *s4lru.Cache, keys int) Summary {
+	s := Summary{
+		Capacity: c.Capacity(),
+		Len:      c.Len(),
+		Stats:    statsOf(c.Stats()),
+	}
+	for seg, o := range c.OccupancyHistogram() {
+		sg := Segment{Len: o.Len, Cap: o.Cap}
+		if keys > 0 {
+			sg.Keys = c.SegmentKeys(seg)
+			if len(sg.Keys) > keys {
+				sg.Keys = sg.Keys[:keys]
+			}
+		}
+		s.Segments = append(s.Segments, sg)
+	}
+	return s
+}
+
+// statsOf converts the cache's Stats for the Summary
+func statsOf(st s4lru.Stats) Stats {
+	return Stats{
+		Hits:              st.Hits,
+		Misses:            st.Misses,
+		Evictions:         st.Evictions,
+		MovePromotions:    st.MovePromotions,
+		SwapPromotions:    st.SwapPromotions,
+		AvgEvictedSegment: st.AvgEvictedSegment,
+		MaxEvictedSegment: st.MaxEvictedSegment,
+	}
+}
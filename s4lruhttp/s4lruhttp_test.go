@@ -0,0 +1,88 @@
+package s4lruhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/dgryski/go-s4lru"
+)
+
+func TestDebugHandler(t *testing.T) {
+
+	c := s4lru.New(8, s4lru.WithStats(true)) // 2 per segment
+	for i := 0; i < 4; i++ {
+		c.Set("k"+strconv.Itoa(i), i)
+	}
+	c.Get("k3")
+	c.Get("k0") // a miss
+	before := c.Snapshot()
+
+	get := func(h http.Handler, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	w := get(DebugHandler(c), "/debug/cache?keys=1")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// check the field names as well as the values
+	var raw map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"capacity", "len", "segments", "stats"} {
+		if _, ok := raw[field]; !ok {
+			t.Errorf("response has no %q field: %s", field, w.Body)
+		}
+	}
+	stats, _ := raw["stats"].(map[string]interface{})
+	for _, field := range []string{"hits", "misses", "evictions", "move_promotions", "swap_promotions", "avg_evicted_segment", "max_evicted_segment"} {
+		if _, ok := stats[field]; !ok {
+			t.Errorf("stats have no %q field: %s", field, w.Body)
+		}
+	}
+
+	var got Summary
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := Summary{
+		Capacity: 8,
+		Len:      2,
+		Segments: []Segment{
+			{Len: 1, Cap: 2, Keys: []string{"k2"}},
+			{Len: 1, Cap: 2, Keys: []string{"k3"}},
+			{Len: 0, Cap: 2},
+			{Len: 0, Cap: 2},
+		},
+		Stats: Stats{Hits: 1, Misses: 1, Evictions: 2, MovePromotions: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summary %+v, want %+v", got, want)
+	}
+
+	// keys are listed only on request, and reading changed nothing
+	w = get(LockedDebugHandler(c, &sync.Mutex{}), "/")
+	got = Summary{}
+	json.Unmarshal(w.Body.Bytes(), &got)
+	for seg, sg := range got.Segments {
+		if sg.Keys != nil {
+			t.Errorf("segment %d listed keys without keys=N", seg)
+		}
+	}
+	if !reflect.DeepEqual(c.Snapshot(), before) {
+		t.Errorf("serving the summary changed the cache")
+	}
+
+	if w := get(DebugHandler(c), "/?keys=x"); w.Code != http.StatusBadRequest {
+		t.Errorf("keys=x: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
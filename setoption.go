@@ -0,0 +1,91 @@
+package s4lru
+
+import "time"
+
+// A SetOption adjusts a single Set.  Several may be given; a later option of
+// the same kind overrides an earlier one.
+type SetOption func(*setConfig)
+
+type setConfig struct {
+	ttl     time.Duration
+	hasTTL  bool
+	seg     int
+	hasSeg  bool
+	cost    int64
+	release *func()
+}
+
+// WithTTL makes the value expire after ttl, as SetWithTTL does, overriding
+// the default TTL of a cache created NewWithTTL.
+func WithTTL(ttl time.Duration) SetOption {
+	return func(cfg *setConfig) {
+		cfg.ttl = ttl
+		cfg.hasTTL = true
+	}
+}
+
+// WithSegment places the item at the front of segment seg, as SetWithSegment
+// does.  Set will panic if seg is out of range.
+func WithSegment(seg int) SetOption {
+	return func(cfg *setConfig) {
+		cfg.seg = seg
+		cfg.hasSeg = true
+	}
+}
+
+// WithCost makes cost the item's cost in a cache created NewWithCost, in
+// place of what its cost func reports, both for admitting it and for as long
+// as it stays, until its value is next replaced.  It is ignored by a cache
+// that counts items.  WithCost will panic if cost is not positive.
+func WithCost(cost int64) SetOption {
+	if cost <= 0 {
+		panic("s4lru: cost must be positive")
+	}
+	return func(cfg *setConfig) {
+		cfg.cost = cost
+	}
+}
+
+// WithPin takes a reference to the stored item, as GetRef does, so that it
+// isn't evicted until the reference is released, and sets *release to the
+// func that releases it.  If the item wasn't stored, *release does nothing.
+func WithPin(release *func()) SetOption {
+	return func(cfg *setConfig) {
+		cfg.release = release
+	}
+}
+
+// setWith is Set with options
+func (c *Cache) setWith(key string, value interface{}, opts []SetOption) {
+	var cfg setConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.hasSeg && (cfg.seg < 0 || cfg.seg >= len(c.lists)) {
+		panic("s4lru: segment out of range")
+	}
+
+	n := c.evictions
+	prevCost := c.setCost
+	c.setCost = cfg.cost
+	if cfg.hasSeg {
+		c.setWithSegment(key, value, cfg.seg)
+	} else {
+		c.set(key, value)
+	}
+	c.setCost = prevCost
+	c.lastSetEvicted = c.evictions != n
+
+	if cfg.hasTTL {
+		c.expireAfter(key, cfg.ttl)
+	} else if c.defaultTTL > 0 {
+		c.expireAfter(key, c.defaultTTL)
+	}
+
+	if cfg.release != nil {
+		*cfg.release = func() {}
+		if i, ok := c.get(key); ok {
+			*cfg.release = c.ref(i)
+		}
+	}
+}
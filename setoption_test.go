@@ -0,0 +1,140 @@
+package s4lru
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSetOptions(t *testing.T) {
+
+	clock := &fakeClock{t: time.Unix(0, 0)}
+
+	c := New(8) // 2 per segment
+	c.Now = clock.Now
+
+	c.Set("ttl", 1, WithTTL(time.Second))
+	c.Set("seg", 2, WithSegment(3))
+	c.Set("both", 3, WithSegment(2), WithTTL(time.Second))
+	c.Set("later", 4, WithTTL(time.Second), WithTTL(time.Hour))
+
+	for key, seg := range map[string]int{"ttl": 0, "seg": 3, "both": 2, "later": 0} {
+		if got := c.items[c.slot(key)].lidx; got != seg {
+			t.Errorf("%s in segment %d, want %d", key, got, seg)
+		}
+	}
+
+	clock.Advance(time.Second)
+	for key, want := range map[string]bool{"ttl": false, "seg": true, "both": false, "later": true} {
+		if _, ok := c.Peek(key); ok != want {
+			t.Errorf("after a second, Peek(%s) ok=%v, want %v", key, ok, want)
+		}
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Set with an out of range WithSegment didn't panic")
+			}
+		}()
+		c.Set("bad", 0, WithSegment(4))
+	}()
+	if c.Contains("bad") {
+		t.Errorf("Set with an out of range WithSegment stored the key")
+	}
+
+	// the cost option is ignored when counting items
+	c.Set("cost", 5, WithCost(100))
+	if v, _ := c.Peek("cost"); v != 5 {
+		t.Errorf("Set with WithCost in a counting cache didn't store the value")
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetWithCost(t *testing.T) {
+
+	c := NewWithCost(40, lenCost) // 10 per segment
+
+	c.Set("a", "aa", WithCost(8))
+	if got := c.items[c.slot("a")].cost; got != 8 {
+		t.Errorf("a has cost %d, want 8", got)
+	}
+	c.Set("b", "bb", WithCost(4)) // segment 0 holds 10, so a goes
+	if c.Contains("a") || !c.Contains("b") {
+		t.Errorf("a=%v b=%v, want only b", c.Contains("a"), c.Contains("b"))
+	}
+
+	c.Set("big", "x", WithCost(11), WithSegment(3))
+	if c.Contains("big") {
+		t.Errorf("stored an item too big for any segment")
+	}
+
+	c.Set("b", "bb") // a replaced value is costed as usual
+	if got := c.items[c.slot("b")].cost; got != 2 {
+		t.Errorf("b has cost %d after an update, want 2", got)
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetWithPin(t *testing.T) {
+
+	c := New(4) // 1 per segment
+
+	var release func()
+	c.Set("pinned", 1, WithPin(&release))
+	c.Set("b", 2)
+	if !c.Contains("pinned") || c.Contains("b") {
+		t.Errorf("a pinned item was evicted: pinned=%v b=%v", c.Contains("pinned"), c.Contains("b"))
+	}
+
+	release()
+	c.Set("b", 2)
+	if c.Contains("pinned") || !c.Contains("b") {
+		t.Errorf("after release: pinned=%v b=%v, want only b", c.Contains("pinned"), c.Contains("b"))
+	}
+
+	// pinning combines with the other options
+	var release2 func()
+	c.Set("top", 3, WithSegment(3), WithPin(&release2), WithTTL(time.Hour))
+	if c.items[c.slot("top")].lidx != 3 || c.inUse != 1 {
+		t.Errorf("top in segment %d with %d items in use, want 3 and 1", c.items[c.slot("top")].lidx, c.inUse)
+	}
+	release2()
+
+	// an item that isn't stored leaves a release that does nothing
+	c = New(0)
+	c.Set("k", 1, WithPin(&release))
+	release()
+	if c.inUse != 0 {
+		t.Errorf("inUse=%d", c.inUse)
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetWithSmallerCost(t *testing.T) {
+
+	// the override decides admission, not the cost function
+	huge := NewWithCost(100, func(key string, value interface{}) int64 { return 1000 })
+	huge.Set("k", "v", WithCost(5))
+	if v, ok := huge.Peek("k"); !ok || v != "v" {
+		t.Errorf("Peek(k)=(%v,%v), want the item admitted at its given cost", v, ok)
+	}
+
+	// and eviction: segment 0 holds 25 items of cost 1
+	c := NewWithCost(100, func(key string, value interface{}) int64 { return 20 })
+	for i := 0; i < 20; i++ {
+		c.Set(strconv.Itoa(i), i, WithCost(1))
+	}
+	if c.Len() != 20 {
+		t.Errorf("Len()=%d after 20 inserts of cost 1, want 20", c.Len())
+	}
+	if err := c.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+}
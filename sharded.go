@@ -0,0 +1,122 @@
+package s4lru
+
+// ShardedCache spreads keys over several SyncCaches by hash, so that
+// goroutines working on different keys rarely contend for the same lock.
+// Each shard is an independent S4LRU cache: recency and eviction are tracked
+// per shard, not globally.
+type ShardedCache struct {
+	shards []*SyncCache
+}
+
+// NewSharded returns a new sharded cache with the given number of shards,
+// sharing capacity between them as evenly as possible.  NewSharded will
+// panic if shards is not positive or capacity is less than shards, since a
+// shard without a slot would silently drop every key that hashes to it.
+func NewSharded(shards, capacity int) *ShardedCache {
+	if shards <= 0 {
+		panic("s4lru: shard count must be positive")
+	}
+	if capacity < shards {
+		panic("s4lru: capacity must be at least the shard count")
+	}
+
+	s := &ShardedCache{shards: make([]*SyncCache, shards)}
+	for i, n := range splitCapacity(capacity, shards) {
+		s.shards[i] = NewSync(n)
+	}
+	return s
+}
+
+// shard returns the shard responsible for key, chosen by its FNV-1a hash
+func (s *ShardedCache) shard(key string) *SyncCache {
+	return s.shards[fnv1a(key)%uint32(len(s.shards))]
+}
+
+// fnv1a returns the 32-bit FNV-1a hash of key
+func fnv1a(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// Get returns a value from the cache
+func (s *ShardedCache) Get(key string) (interface{}, bool) {
+	return s.shard(key).Get(key)
+}
+
+// Set sets a value in the cache
+func (s *ShardedCache) Set(key string, value interface{}) {
+	s.shard(key).Set(key, value)
+}
+
+// Remove removes an item from the cache, returning the item and a boolean indicating if it was found
+func (s *ShardedCache) Remove(key string) (interface{}, bool) {
+	return s.shard(key).Remove(key)
+}
+
+// Len returns the total number of items in all shards.  The shards are
+// counted one at a time, so the total is only approximate while other
+// goroutines are using the cache.
+func (s *ShardedCache) Len() int {
+	n := 0
+	for _, sh := range s.shards {
+		n += sh.Len()
+	}
+	return n
+}
+
+// Stats returns the sum of the counters of every shard, with the eviction
+// depth averaged over all their evictions and its highest taken.  Each
+// counter is read atomically, but the shards are read one after another, so
+// the total may mix in updates made while it was being computed.
+func (s *ShardedCache) Stats() Stats {
+	var total Stats
+	var peaks float64
+	for _, st := range s.ShardStats() {
+		total.Hits += st.Hits
+		total.Misses += st.Misses
+		total.Evictions += st.Evictions
+		total.MovePromotions += st.MovePromotions
+		total.SwapPromotions += st.SwapPromotions
+		peaks += st.AvgEvictedSegment * float64(st.Evictions)
+		if st.MaxEvictedSegment > total.MaxEvictedSegment {
+			total.MaxEvictedSegment = st.MaxEvictedSegment
+		}
+	}
+	if total.Evictions > 0 {
+		total.AvgEvictedSegment = peaks / float64(total.Evictions)
+	}
+	return total
+}
+
+// ShardStats returns the counters of each shard, for spotting shards that
+// receive a disproportionate share of the traffic
+func (s *ShardedCache) ShardStats() []Stats {
+	stats := make([]Stats, len(s.shards))
+	for i, sh := range s.shards {
+		stats[i] = sh.Stats()
+	}
+	return stats
+}
+
+// Imbalance returns the length of the fullest shard divided by the average
+// shard length: 1 when keys are spread evenly, up to the number of shards
+// when they all land in one.  A high value points to a skewed key set or a
+// poor fit for the hash.  It is 0 for an empty cache.
+func (s *ShardedCache) Imbalance() float64 {
+	total, max := 0, 0
+	for _, sh := range s.shards {
+		n := sh.Len()
+		total += n
+		if n > max {
+			max = n
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(max) * float64(len(s.shards)) / float64(total)
+}
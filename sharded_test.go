@@ -0,0 +1,179 @@
+package s4lru
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestShardedStats(t *testing.T) {
+
+	const (
+		goroutines = 8
+		ops        = 1000
+	)
+
+	s := NewSharded(4, 64)
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < ops; i++ {
+				key := strconv.Itoa((g*ops + i) % 200)
+				if _, ok := s.Get(key); !ok {
+					s.Set(key, i)
+				}
+				// reading stats while the shards are busy must not race
+				s.Stats()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	total := s.Stats()
+	var sum Stats
+	for _, st := range s.ShardStats() {
+		sum.Hits += st.Hits
+		sum.Misses += st.Misses
+		sum.Evictions += st.Evictions
+	}
+	if sum != total {
+		t.Errorf("per-shard stats sum to %+v, aggregate is %+v", sum, total)
+	}
+	if total.Hits+total.Misses != goroutines*ops {
+		t.Errorf("hits+misses=%d, want %d", total.Hits+total.Misses, goroutines*ops)
+	}
+	if n := s.Len(); n > 64 {
+		t.Errorf("Len()=%d exceeds capacity 64", n)
+	}
+}
+
+// uniformTrace returns a sequence of n lookups spread evenly over
+// 2*capacity keys, the counterpart of benchTrace's zipf distribution
+func uniformTrace(capacity, n int) []string {
+	r := rand.New(rand.NewSource(1))
+	trace := make([]string, n)
+	for i := range trace {
+		trace[i] = strconv.Itoa(r.Intn(2 * capacity))
+	}
+	return trace
+}
+
+// BenchmarkConcurrent runs a mixed read-mostly workload, a Set after each
+// miss, over SyncCache and ShardedCache for a range of goroutine counts and
+// key distributions
+func BenchmarkConcurrent(b *testing.B) {
+
+	const capacity = 1 << 12
+
+	type cache interface {
+		Get(key string) (interface{}, bool)
+		Set(key string, value interface{})
+	}
+
+	traces := []struct {
+		name  string
+		trace []string
+	}{
+		{"uniform", uniformTrace(capacity, 1<<16)},
+		{"zipf", benchTrace(capacity, 1<<16)},
+	}
+
+	caches := []struct {
+		name string
+		new  func() cache
+	}{
+		{"sync", func() cache { return NewSync(capacity) }},
+		{"sharded", func() cache { return NewSharded(16, capacity) }},
+	}
+
+	for _, tr := range traces {
+		for _, cc := range caches {
+			for _, goroutines := range []int{1, 4, 16, 64} {
+				name := fmt.Sprintf("%s/%s/goroutines=%d", tr.name, cc.name, goroutines)
+				b.Run(name, func(b *testing.B) {
+					c := cc.new()
+					trace := tr.trace
+					for _, key := range trace {
+						c.Set(key, key)
+					}
+
+					b.ReportAllocs()
+					b.ResetTimer()
+
+					var wg sync.WaitGroup
+					for g := 0; g < goroutines; g++ {
+						wg.Add(1)
+						go func(g int) {
+							defer wg.Done()
+							for i := g; i < b.N; i += goroutines {
+								key := trace[i&(len(trace)-1)]
+								if _, ok := c.Get(key); !ok {
+									c.Set(key, key)
+								}
+							}
+						}(g)
+					}
+					wg.Wait()
+				})
+			}
+		}
+	}
+}
+
+func TestShardedImbalance(t *testing.T) {
+
+	s := NewSharded(4, 4096)
+	if r := s.Imbalance(); r != 0 {
+		t.Errorf("Imbalance() of an empty cache = %v, want 0", r)
+	}
+
+	for i := 0; i < 2000; i++ {
+		s.Set(strconv.Itoa(i), i)
+	}
+	if r := s.Imbalance(); r < 1 || r > 1.1 {
+		t.Errorf("Imbalance() for uniform keys = %v, want close to 1", r)
+	}
+
+	// only keys that hash to the first shard
+	s = NewSharded(4, 4096)
+	for i, n := 0, 0; n < 500; i++ {
+		key := strconv.Itoa(i)
+		if s.shard(key) == s.shards[0] {
+			s.Set(key, i)
+			n++
+		}
+	}
+	if r := s.Imbalance(); r != 4 {
+		t.Errorf("Imbalance() with every key in one shard = %v, want 4", r)
+	}
+}
+
+func TestNewShardedCapacity(t *testing.T) {
+
+	for _, capacity := range []int{-1, 0, 15} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewSharded(16, %d) didn't panic", capacity)
+				}
+			}()
+			NewSharded(16, capacity)
+		}()
+	}
+
+	// every shard can store something
+	s := NewSharded(16, 16)
+	for i := 0; i < 1000; i++ {
+		s.Set(strconv.Itoa(i), i)
+	}
+	for i, sh := range s.shards {
+		if sh.Len() == 0 {
+			t.Errorf("shard %d is empty after 1000 inserts", i)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+//go:build go1.24
+
+package s4lru
+
+import "weak"
+
+// SoftCache is an S4LRU cache whose values may be reclaimed by the garbage
+// collector.  It is not safe for concurrent access.
+//
+// Values are held through weak pointers, so the cache itself never keeps a
+// value alive.  This is useful for large objects that are expensive but
+// possible to reconstruct, and that are otherwise referenced elsewhere in the
+// program for as long as they are in use.  A Get for a value that has been
+// collected is reported as a miss and the entry is dropped.
+//
+// Caveats:
+//
+//   - Go has no notion of memory pressure for weak pointers.  A value that is
+//     only reachable from the cache may be collected at the very next GC
+//     cycle, however much memory is free, so SoftCache is not a substitute for
+//     a strongly held cache sized to fit in memory.
+//   - Collection is only observed lazily.  Collected entries keep occupying a
+//     slot, and are counted by Len, until they are looked up or evicted.
+//   - Values must be pointers to distinct allocations.  Small pointer-free
+//     objects may be batched together by the allocator and kept alive longer
+//     than expected, and pointers to zero-sized values are never reliably
+//     collected.
+//   - Storing a nil pointer is equivalent to storing an already collected
+//     value: Get reports it as missing.
+type SoftCache[T any] struct {
+	c *Cache
+}
+
+// NewSoft returns a new SoftCache with the given capacity.  It has the same
+// restrictions on capacity as New.
+func NewSoft[T any](capacity int) *SoftCache[T] {
+	return &SoftCache[T]{c: New(capacity)}
+}
+
+// Get returns a value from the cache, or false if it is missing or has been
+// reclaimed by the garbage collector
+func (s *SoftCache[T]) Get(key string) (*T, bool) {
+	v, ok := s.c.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	p := v.(weak.Pointer[T]).Value()
+	if p == nil {
+		s.c.Remove(key)
+		return nil, false
+	}
+
+	return p, true
+}
+
+// Set sets a value in the cache without keeping it alive
+func (s *SoftCache[T]) Set(key string, value *T) {
+	s.c.Set(key, weak.Make(value))
+}
+
+// Len returns the total number of items in the cache, including values that
+// have been collected but not yet observed as missing
+func (s *SoftCache[T]) Len() int {
+	return s.c.Len()
+}
+
+// Remove removes an item from the cache, returning the item and a boolean
+// indicating if it was found and still live
+func (s *SoftCache[T]) Remove(key string) (*T, bool) {
+	v, ok := s.c.Remove(key)
+	if !ok {
+		return nil, false
+	}
+
+	p := v.(weak.Pointer[T]).Value()
+	return p, p != nil
+}
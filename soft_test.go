@@ -0,0 +1,38 @@
+//go:build go1.24
+
+package s4lru
+
+import (
+	"runtime"
+	"testing"
+)
+
+type softValue struct {
+	name string
+	buf  [1 << 12]byte
+}
+
+func TestSoftCache(t *testing.T) {
+
+	c := NewSoft[softValue](8)
+
+	live := &softValue{name: "live"}
+	c.Set("live", live)
+	c.Set("dropped", &softValue{name: "dropped"})
+
+	runtime.GC()
+
+	if v, ok := c.Get("live"); !ok || v.name != "live" {
+		t.Errorf("lost a value that is still referenced")
+	}
+
+	if _, ok := c.Get("dropped"); ok {
+		t.Errorf("got a value that should have been collected")
+	}
+
+	if c.Len() != 1 {
+		t.Errorf("collected entry was not dropped: Len()=%d", c.Len())
+	}
+
+	runtime.KeepAlive(live)
+}
@@ -0,0 +1,215 @@
+package s4lru
+
+import "sync/atomic"
+
+// Stats holds counters describing the activity of a cache
+type Stats struct {
+	Hits      uint64 // lookups that found a live item
+	Misses    uint64 // lookups that found nothing, or an expired item
+	Evictions uint64 // items dropped to make room for others
+
+	// Promotions, by the path they took: MovePromotions moved an
+	// item into a segment with room, SwapPromotions swapped it with the
+	// tail of a full one.  A high share of swaps means the upper segments
+	// are chronically full.
+	MovePromotions uint64
+	SwapPromotions uint64
+
+	// The mean and the highest of the top segments evicted items had
+	// reached.  Items are almost always evicted from the back of segment
+	// 0, so these record how far they climbed beforehand: a mean near 0
+	// means few evicted items were ever promoted, and the upper segments
+	// were doing little for them, while a high one means that items fall
+	// out despite being promoted, and more segments could help.
+	AvgEvictedSegment float64
+	MaxEvictedSegment int
+}
+
+// counters are updated atomically so that Stats can be read while another
+// goroutine holds the lock of a SyncCache
+type counters struct {
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	moves     uint64
+	swaps     uint64
+	peaks     uint64 // sum of the peak segments of evicted items
+	maxPeak   uint64
+}
+
+func (s *counters) hit(enabled bool) {
+	if enabled {
+		atomic.AddUint64(&s.hits, 1)
+	}
+}
+
+func (s *counters) miss(enabled bool) {
+	if enabled {
+		atomic.AddUint64(&s.misses, 1)
+	}
+}
+
+// Stats returns a snapshot of the cache's counters.  Unlike the other
+// methods, it is safe to call concurrently with other use of the cache.
+// Counters are only kept for caches created WithStats(true), and for
+// SyncCaches unless created WithStats(false); otherwise they stay zero.
+func (c *Cache) Stats() Stats {
+	st := Stats{
+		Hits:      atomic.LoadUint64(&c.stats.hits),
+		Misses:    atomic.LoadUint64(&c.stats.misses),
+		Evictions: atomic.LoadUint64(&c.stats.evictions),
+
+		MovePromotions: atomic.LoadUint64(&c.stats.moves),
+		SwapPromotions: atomic.LoadUint64(&c.stats.swaps),
+
+		MaxEvictedSegment: int(atomic.LoadUint64(&c.stats.maxPeak)),
+	}
+	if st.Evictions > 0 {
+		st.AvgEvictedSegment = float64(atomic.LoadUint64(&c.stats.peaks)) / float64(st.Evictions)
+	}
+	return st
+}
+
+// reached records that item i has been placed in segment seg, for the
+// eviction depth stats
+func (c *Cache) reached(i int32, seg int) {
+	if x := c.items[i].ext(); seg > x.peak {
+		x.peak = seg
+	}
+}
+
+// transition records a hit that moved an item from segment from to segment to
+func (c *Cache) transition(from, to int) {
+	n := len(c.lists)
+	if c.transitions == nil {
+		c.transitions = make([]uint64, n*n)
+	}
+	c.transitions[from*n+to]++
+}
+
+// TransitionMatrix returns, for each segment i, the fraction of the hits on
+// items in segment i that left them in each segment j, as m[i][j].  Each row
+// with any hits sums to 1; rows for segments that saw none are all zero.
+// Hits are only counted while stats are kept, see WithStats, and since the
+// last Reshape.  The matrix shows how items flow between the segments, for
+// example whether the top segment's hits mostly stay there or promotions
+// mostly swap items back and forth.
+func (c *Cache) TransitionMatrix() [][]float64 {
+	n := len(c.lists)
+	m := make([][]float64, n)
+	for from := range m {
+		m[from] = make([]float64, n)
+		if c.transitions == nil {
+			continue
+		}
+		row := c.transitions[from*n : (from+1)*n]
+		var total uint64
+		for _, hits := range row {
+			total += hits
+		}
+		for to, hits := range row {
+			if total > 0 {
+				m[from][to] = float64(hits) / float64(total)
+			}
+		}
+	}
+	return m
+}
+
+// evictionWindowOps is the number of operations in each half of the window
+// EvictionRate is computed over
+const evictionWindowOps = 1024
+
+// evictionWindow counts operations and evictions over the last one to two
+// evictionWindowOps operations
+type evictionWindow struct {
+	ops, evictions         uint64 // current half
+	prevOps, prevEvictions uint64 // previous, complete, half
+}
+
+func (w *evictionWindow) op() {
+	if w.ops >= evictionWindowOps {
+		w.prevOps, w.prevEvictions = w.ops, w.evictions
+		w.ops, w.evictions = 0, 0
+	}
+	w.ops++
+}
+
+func (w *evictionWindow) evicted() {
+	w.evictions++
+}
+
+// EvictionRate returns the number of evictions per Get or Set over roughly
+// the last 1024 to 2048 operations.  A rate close to 1 means nearly every
+// operation pushes an item out of the cache, i.e. the cache is thrashing; a
+// rate close to 0 means the working set fits.
+func (c *Cache) EvictionRate() float64 {
+	w := &c.window
+	ops := w.ops + w.prevOps
+	if ops == 0 {
+		return 0
+	}
+	return float64(w.evictions+w.prevEvictions) / float64(ops)
+}
+
+// evict evicts item i from the cache
+func (c *Cache) evict(i int32) {
+	c.evicted(i, c.items[i].lidx)
+	c.unlink(i)
+	c.delStored(c.items[i].key)
+	c.release(i)
+}
+
+// evicted records that item i is being evicted from segment seg
+func (c *Cache) evicted(i int32, seg int) {
+	if c.Logger != nil {
+		c.Logger("evict %q segment=%d", c.items[i].key, seg)
+	}
+	if c.countStats {
+		peak := seg
+		if x := c.items[i].extra; x != nil && x.peak > peak {
+			peak = x.peak
+		}
+		atomic.AddUint64(&c.stats.peaks, uint64(peak))
+		if uint64(peak) > atomic.LoadUint64(&c.stats.maxPeak) {
+			atomic.StoreUint64(&c.stats.maxPeak, uint64(peak))
+		}
+		atomic.AddUint64(&c.stats.evictions, 1)
+	}
+	c.window.evicted()
+	c.evictions++
+	c.lists[seg].evictions++
+	if c.ghost != nil {
+		c.ghost.add(c.items[i].key)
+	}
+	if c.departed != nil {
+		c.departed.add(c.items[i].key)
+	}
+	if c.OnEvict != nil {
+		c.OnEvict(c.items[i].key, c.items[i].value)
+	}
+	if c.collect != nil {
+		*c.collect = append(*c.collect, Entry{Key: c.items[i].key, Value: c.items[i].value, Segment: seg})
+	}
+	if c.evictCh != nil {
+		select {
+		case c.evictCh <- Entry{Key: c.items[i].key, Value: c.items[i].value, Segment: seg}:
+		default:
+			atomic.AddUint64(&c.evictDrops, 1)
+		}
+	}
+}
+
+// EvictionChan returns the channel a cache created WithEvictionChan sends
+// its evictions on, or nil for any other cache.  The channel is never
+// closed.
+func (c *Cache) EvictionChan() <-chan Entry {
+	return c.evictCh
+}
+
+// EvictionsDropped returns the number of evictions not sent on the
+// EvictionChan because its buffer was full.  It is safe to call from the
+// goroutine draining the channel.
+func (c *Cache) EvictionsDropped() uint64 {
+	return atomic.LoadUint64(&c.evictDrops)
+}
@@ -0,0 +1,295 @@
+package s4lru
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+
+	c := New(4, WithStats(true))
+
+	c.Set("a", 1)
+	c.Get("a")
+	c.Get("a")
+	c.Get("b")
+	c.Set("b", 2)
+	c.Set("c", 3)
+
+	want := Stats{Hits: 2, Misses: 1, Evictions: 1, MovePromotions: 2}
+	if got := c.Stats(); got != want {
+		t.Errorf("Stats()=%+v, want %+v", got, want)
+	}
+}
+
+func TestEvictionRate(t *testing.T) {
+
+	c := New(64)
+
+	if r := c.EvictionRate(); r != 0 {
+		t.Errorf("EvictionRate() on a new cache = %v, want 0", r)
+	}
+
+	// a stream of new keys evicts on nearly every Set
+	for i := 0; i < 4*evictionWindowOps; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+
+	if r := c.EvictionRate(); r < 0.9 {
+		t.Errorf("EvictionRate() while thrashing = %v, want close to 1", r)
+	}
+
+	// repeatedly reading a handful of cached keys evicts nothing
+	for i := 0; i < 4*evictionWindowOps; i++ {
+		c.Get(strconv.Itoa(4*evictionWindowOps - 1 - i%8))
+	}
+
+	if r := c.EvictionRate(); r != 0 {
+		t.Errorf("EvictionRate() for a friendly workload = %v, want 0", r)
+	}
+}
+
+func TestStatsDisabled(t *testing.T) {
+
+	c := New(4)
+	c.Set("a", 1)
+	c.Get("a")
+	c.Get("b")
+	for i := 0; i < 8; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	if got := c.Stats(); got != (Stats{}) {
+		t.Errorf("Stats()=%+v with stats off, want zeros", got)
+	}
+
+	s := NewSync(4)
+	s.Get("a")
+	if got := s.Stats(); got.Misses != 1 {
+		t.Errorf("SyncCache Stats()=%+v, want stats on by default", got)
+	}
+
+	s = NewSync(4, WithStats(false))
+	s.Get("a")
+	if got := s.Stats(); got != (Stats{}) {
+		t.Errorf("SyncCache Stats()=%+v WithStats(false), want zeros", got)
+	}
+}
+
+func benchmarkGetStats(b *testing.B, enabled bool) {
+	c := New(1024, WithStats(enabled))
+	for i := 0; i < 1024; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i % 2048)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Get(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkGetStatsOn(b *testing.B)  { benchmarkGetStats(b, true) }
+func BenchmarkGetStatsOff(b *testing.B) { benchmarkGetStats(b, false) }
+
+func TestSegmentEvictions(t *testing.T) {
+
+	c := New(8)
+
+	// fill segment 1 through promotions, then push a third item up to
+	// swap out segment 1's tail
+	c.Set("a", 1)
+	c.Get("a")
+	c.Set("b", 2)
+	c.Get("b")
+	c.Set("c", 3)
+	c.Get("c") // swaps with a: segment 1 sheds one
+
+	// overflow segment 0 twice
+	c.Set("d", 4)
+	c.Set("e", 5)
+	c.Set("f", 6)
+
+	want := []uint64{2, 1, 0, 0}
+	if got := c.SegmentEvictions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("SegmentEvictions()=%v, want %v", got, want)
+	}
+}
+
+func TestTransitionMatrix(t *testing.T) {
+
+	c := New(8, WithStats(true)) // 2 per segment
+
+	c.Set("a", 1)
+	for i := 0; i < 5; i++ {
+		c.Get("a") // 0->1, 1->2, 2->3, then 3->3 twice
+	}
+	c.Set("b", 2)
+	c.Get("b") // 0->1
+
+	want := [][]float64{
+		{0, 1, 0, 0},
+		{0, 0, 1, 0},
+		{0, 0, 0, 1},
+		{0, 0, 0, 1},
+	}
+	if got := c.TransitionMatrix(); !reflect.DeepEqual(got, want) {
+		t.Errorf("TransitionMatrix()=%v, want %v", got, want)
+	}
+	if got := c.transitions[0*4+1]; got != 2 {
+		t.Errorf("recorded %d hits from segment 0 to 1, want 2", got)
+	}
+
+	c.Reshape(2)
+	if got := c.TransitionMatrix(); !reflect.DeepEqual(got, [][]float64{{0, 0}, {0, 0}}) {
+		t.Errorf("TransitionMatrix() after Reshape=%v, want zeros", got)
+	}
+
+	c = New(8)
+	c.Set("a", 1)
+	c.Get("a")
+	if got := c.TransitionMatrix(); got[0][1] != 0 {
+		t.Errorf("counted transitions with stats off: %v", got)
+	}
+}
+
+func TestPromotionStats(t *testing.T) {
+
+	c := New(8, WithStats(true)) // 2 per segment
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a")
+	c.Get("b") // both moved into segment 1, filling it
+	c.Set("c", 3)
+	c.Get("c") // swapped with a
+
+	st := c.Stats()
+	if st.MovePromotions != 2 || st.SwapPromotions != 1 {
+		t.Errorf("MovePromotions=%d SwapPromotions=%d, want 2 and 1", st.MovePromotions, st.SwapPromotions)
+	}
+}
+
+func TestEvictedSegmentStats(t *testing.T) {
+
+	c := New(4, WithStats(true)) // 1 per segment
+
+	c.Set("a", 1)
+	c.Get("a") // a climbs to segment 1
+	c.Set("b", 2)
+	c.Get("b") // and b swaps it back down
+	c.Set("c", 3)
+	c.Set("d", 4) // evicting a, which reached 1, then c, which never left 0
+
+	want := Stats{Hits: 2, Evictions: 2, MovePromotions: 1, SwapPromotions: 1, AvgEvictedSegment: 0.5, MaxEvictedSegment: 1}
+	if got := c.Stats(); got != want {
+		t.Errorf("Stats()=%+v, want %+v", got, want)
+	}
+
+	c.Get("d")
+	c.Get("d")
+	c.Get("d")        // to the top, sending b down to segment 0
+	c.Set("e", 5)     // and evicting b, which reached 1
+	c.ResetSegment(3) // d goes from the top
+
+	st := c.Stats()
+	if st.Evictions != 4 || st.AvgEvictedSegment != 5.0/4 || st.MaxEvictedSegment != 3 {
+		t.Errorf("Evictions=%d AvgEvictedSegment=%v MaxEvictedSegment=%d, want 4, 1.25 and 3", st.Evictions, st.AvgEvictedSegment, st.MaxEvictedSegment)
+	}
+
+	// nothing is tracked without stats
+	c = New(4)
+	c.Set("a", 1)
+	c.Get("a")
+	if c.items[c.slot("a")].extra != nil {
+		t.Errorf("a promotion allocated item state in a cache without stats")
+	}
+}
+
+func TestDistinctKeysSeen(t *testing.T) {
+
+	c := New(8, WithDistinctKeys(4)) // 2 per segment
+
+	for _, key := range []string{"a", "b", "a", "b"} {
+		c.Set(key, nil)
+	}
+	if n := c.DistinctKeysSeen(); n != 2 {
+		t.Fatalf("DistinctKeysSeen()=%d after repeats, want 2", n)
+	}
+
+	// a and b were promoted by their updates, leaving segment 0 empty
+	c.Set("c", nil)
+	c.Set("d", nil)
+	c.Set("x", nil) // evicts c
+	c.Remove("a")
+	c.Set("c", nil) // back from eviction
+	c.Set("a", nil) // back from removal
+	c.SetKeepSegment("e", nil)
+	if n := c.DistinctKeysSeen(); n != 6 {
+		t.Errorf("DistinctKeysSeen()=%d, want 6", n)
+	}
+
+	// with the recent keys forgotten, a returning key counts again
+	for i := 0; i < 20; i++ {
+		c.Set(strconv.Itoa(i), nil)
+	}
+	before := c.DistinctKeysSeen()
+	c.Set("c", nil)
+	if n := c.DistinctKeysSeen(); n != before+1 {
+		t.Errorf("long-gone key counted %d times, want once", n-before)
+	}
+
+	if n := New(8).DistinctKeysSeen(); n != 0 {
+		t.Errorf("counted without WithDistinctKeys")
+	}
+}
+
+func TestEvictionChan(t *testing.T) {
+
+	if New(4).EvictionChan() != nil {
+		t.Errorf("EvictionChan of a cache without WithEvictionChan isn't nil")
+	}
+
+	c := New(4, WithEvictionChan(8)) // 1 per segment
+	for i := 0; i < 4; i++ {
+		c.Set("k"+strconv.Itoa(i), i)
+	}
+	c.Remove("k3") // removals aren't evictions
+
+	var got []Entry
+	for len(c.EvictionChan()) > 0 {
+		got = append(got, <-c.EvictionChan())
+	}
+	want := []Entry{{"k0", 0, 0}, {"k1", 1, 0}, {"k2", 2, 0}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("evictions %v, want %v", got, want)
+	}
+	if n := c.EvictionsDropped(); n != 0 {
+		t.Errorf("EvictionsDropped()=%d, want 0", n)
+	}
+}
+
+func TestEvictionChanDrops(t *testing.T) {
+
+	c := New(4, WithEvictionChan(2))
+	for i := 0; i < 10; i++ {
+		c.Set("k"+strconv.Itoa(i), i)
+	}
+
+	// the first two evictions filled the buffer and the other seven were
+	// dropped, without blocking Set
+	if n := c.EvictionsDropped(); n != 7 {
+		t.Errorf("EvictionsDropped()=%d, want 7", n)
+	}
+	if e := <-c.EvictionChan(); e.Key != "k0" {
+		t.Errorf("first eviction %v, want k0", e)
+	}
+
+	// draining makes room for the next
+	c.Set("k10", 10)
+	if n := c.EvictionsDropped(); n != 7 || len(c.EvictionChan()) != 2 {
+		t.Errorf("after draining one: %d dropped, %d buffered, want 7 and 2", n, len(c.EvictionChan()))
+	}
+}
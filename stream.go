@@ -0,0 +1,94 @@
+package s4lru
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Stream copies the contents of a Cache to and from a byte stream one entry
+// at a time, so that a large cache can be saved without building the whole
+// Snapshot in memory.  The caller provides the encoding of a single Entry;
+// Stream frames each encoded entry with its length as a 4-byte big-endian
+// integer.  Entries are written hottest first, as Snapshot returns them, so
+// that reading a stream back into a cache with the same segment capacities
+// reproduces it as Restore does.
+type Stream struct {
+	Cache  *Cache
+	Encode func(Entry) ([]byte, error) // used by WriteTo
+	Decode func([]byte) (Entry, error) // used by ReadFrom
+}
+
+// WriteTo writes every entry of the cache to w, implementing io.WriterTo.  It
+// returns the number of bytes written, including those of a partially
+// written frame if w fails, and the first error from w or Encode.  Nothing is
+// promoted.  Encode must not modify the cache.
+func (s *Stream) WriteTo(w io.Writer) (int64, error) {
+	c := s.Cache
+	var written int64
+	var hdr [4]byte
+	for seg := len(c.lists) - 1; seg >= 0; seg-- {
+		for i := c.lists[seg].head; i != 0; i = c.items[i].next {
+			b, err := s.Encode(Entry{Key: c.items[i].key, Value: c.items[i].value, Segment: seg})
+			if err != nil {
+				return written, err
+			}
+			binary.BigEndian.PutUint32(hdr[:], uint32(len(b)))
+			n, err := w.Write(hdr[:])
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+			n, err = w.Write(b)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// ReadFrom replaces the contents of the cache with the entries read from r,
+// implementing io.ReaderFrom.  Entries are placed as by Restore: each at the
+// back of its segment, spilling down when that is full, and dropped if it
+// fits nowhere.  Reading stops at the end of r; a stream that ends within a
+// frame is reported as io.ErrUnexpectedEOF.  It returns the number of bytes
+// read and the first error from r or Decode, keeping the entries read so far.
+// Each frame is read into a fresh slice, which Decode may keep.
+func (s *Stream) ReadFrom(r io.Reader) (int64, error) {
+	c := s.Cache
+	c.reset()
+
+	var read int64
+	var hdr [4]byte
+	for {
+		n, err := io.ReadFull(r, hdr[:])
+		read += int64(n)
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+
+		// the buffer grows only as the frame's bytes actually arrive, so
+		// a corrupt length can't force a huge allocation up front
+		var buf bytes.Buffer
+		size := int64(binary.BigEndian.Uint32(hdr[:]))
+		m, err := io.CopyN(&buf, r, size)
+		read += m
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return read, err
+		}
+
+		e, err := s.Decode(buf.Bytes())
+		if err != nil {
+			return read, err
+		}
+		c.restore(e)
+	}
+}
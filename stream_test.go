@@ -0,0 +1,194 @@
+package s4lru
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func encodeJSON(e Entry) ([]byte, error) { return json.Marshal(e) }
+
+func TestStreamWriteTo(t *testing.T) {
+
+	c := New(16)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		c.Set(k, k+"!")
+		if k < "c" {
+			c.Get(k)
+		}
+	}
+
+	var buf bytes.Buffer
+	s := &Stream{Cache: c, Encode: encodeJSON}
+	n, err := s.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo reported %d bytes, wrote %d", n, buf.Len())
+	}
+
+	var got []Entry
+	for buf.Len() > 0 {
+		size := binary.BigEndian.Uint32(buf.Next(4))
+		var e Entry
+		if err := json.Unmarshal(buf.Next(int(size)), &e); err != nil {
+			t.Fatalf("decoding entry: %v", err)
+		}
+		got = append(got, e)
+	}
+	if want := c.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("streamed %v, want %v", got, want)
+	}
+}
+
+// limitedWriter fails once n bytes have been written
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+var errShortWrite = errors.New("short write")
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.n {
+		n, _ := l.w.Write(p[:l.n])
+		l.n = 0
+		return n, errShortWrite
+	}
+	l.n -= len(p)
+	return l.w.Write(p)
+}
+
+func TestStreamWriteToError(t *testing.T) {
+
+	c := New(16)
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	var buf bytes.Buffer
+	s := &Stream{Cache: c, Encode: encodeJSON}
+	n, err := s.WriteTo(&limitedWriter{w: &buf, n: 10})
+	if err != errShortWrite {
+		t.Errorf("WriteTo: err=%v, want errShortWrite", err)
+	}
+	if n != 10 || buf.Len() != 10 {
+		t.Errorf("WriteTo reported %d bytes and wrote %d before failing, want 10", n, buf.Len())
+	}
+
+	errEncode := errors.New("can't encode")
+	s.Encode = func(Entry) ([]byte, error) { return nil, errEncode }
+	if n, err := s.WriteTo(&buf); n != 0 || err != errEncode {
+		t.Errorf("WriteTo with a failing Encode=(%d,%v), want (0,%v)", n, err, errEncode)
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+
+	c := New(16)
+	for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		c.Set(k, k+"!")
+		if k < "d" {
+			c.Get(k)
+			c.Get(k)
+		}
+	}
+
+	var buf bytes.Buffer
+	s := &Stream{
+		Cache:  c,
+		Encode: encodeJSON,
+		Decode: func(b []byte) (Entry, error) {
+			var e Entry
+			err := json.Unmarshal(b, &e)
+			return e, err
+		},
+	}
+	written, err := s.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	dump := append([]byte(nil), buf.Bytes()...)
+
+	r := New(16)
+	r.Set("stale", 1)
+	s.Cache = r
+	read, err := s.ReadFrom(&buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if read != written {
+		t.Errorf("ReadFrom read %d bytes, WriteTo wrote %d", read, written)
+	}
+	if got, want := r.Snapshot(), c.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip gave %v, want %v", got, want)
+	}
+	if err := r.checkInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	// a stream cut short within a frame keeps what came before
+	if _, err := s.ReadFrom(bytes.NewReader(dump[:len(dump)-3])); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadFrom a truncated stream: err=%v, want io.ErrUnexpectedEOF", err)
+	}
+	if r.Len() != c.Len()-1 {
+		t.Errorf("ReadFrom a truncated stream kept %d entries, want %d", r.Len(), c.Len()-1)
+	}
+}
+
+func TestStreamReadFromRetainedFrames(t *testing.T) {
+
+	c := New(16)
+	c.Set("a", "aaaa")
+	c.Set("b", "bbbb")
+
+	var buf bytes.Buffer
+	s := &Stream{
+		Cache:  c,
+		Encode: func(e Entry) ([]byte, error) { return []byte(e.Key + e.Value.(string)), nil },
+		// keep the frame itself as the value
+		Decode: func(b []byte) (Entry, error) { return Entry{Key: string(b[:1]), Value: b[1:]}, nil },
+	}
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	r := New(16)
+	s.Cache = r
+	if _, err := s.ReadFrom(&buf); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if v, _ := r.Peek(k); string(v.([]byte)) != k+k+k+k {
+			t.Errorf("%s=%q, a later frame overwrote it", k, v)
+		}
+	}
+}
+
+func TestStreamReadFromCorruptLength(t *testing.T) {
+
+	// a length of 4GiB followed by a few bytes
+	stream := []byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3}
+
+	s := &Stream{Cache: New(16), Decode: func(b []byte) (Entry, error) { return Entry{}, nil }}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	n, err := s.ReadFrom(bytes.NewReader(stream))
+	runtime.ReadMemStats(&after)
+
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadFrom a corrupt frame: err=%v, want io.ErrUnexpectedEOF", err)
+	}
+	if n != int64(len(stream)) {
+		t.Errorf("ReadFrom read %d bytes, want %d", n, len(stream))
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Errorf("a corrupt frame length made ReadFrom allocate %d bytes", alloc)
+	}
+}
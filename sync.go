@@ -0,0 +1,320 @@
+package s4lru
+
+import (
+	"sync"
+	"time"
+)
+
+// SyncCache is an S4LRU cache that is safe for concurrent access.
+type SyncCache struct {
+	mu sync.Mutex
+	c  *Cache
+}
+
+// NewSync returns a new concurrency-safe S4LRU cache with the given capacity
+// and options.  It has the same restrictions on capacity as New.  Unlike for
+// New, Stats are collected unless disabled WithStats(false).
+func NewSync(capacity int, opts ...Option) *SyncCache {
+	return &SyncCache{c: New(capacity, append([]Option{WithStats(true)}, opts...)...)}
+}
+
+// reservation is the placeholder value stored for a key between Reserve and
+// commit/cancel.  It is never returned to callers.
+type reservation struct{}
+
+// Get returns a value from the cache.  Keys that are reserved but not yet
+// committed are reported as missing, counted as misses, and not promoted.
+func (s *SyncCache) Get(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(key)
+}
+
+// get is Get for callers holding the lock
+func (s *SyncCache) get(key string) (interface{}, bool) {
+	if i, ok := s.c.get(key); ok {
+		if _, reserved := s.c.items[i].value.(*reservation); reserved {
+			s.c.window.op()
+			s.c.stats.miss(s.c.countStats)
+			return nil, false
+		}
+	}
+	return s.c.Get(key)
+}
+
+// GetAndModify replaces the value stored under key with fn's result, as
+// Cache.GetAndModify does, with the lookup, fn and the store all under a
+// single lock.  Reserved keys are reported as missing without calling fn.
+func (s *SyncCache) GetAndModify(key string, fn func(value interface{}) interface{}) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i, ok := s.c.get(key); ok {
+		if _, reserved := s.c.items[i].value.(*reservation); reserved {
+			s.c.window.op()
+			s.c.stats.miss(s.c.countStats)
+			return nil, false
+		}
+	}
+	return s.c.GetAndModify(key, fn)
+}
+
+// Peek returns a value from the cache without promoting it
+func (s *SyncCache) Peek(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peek(key)
+}
+
+// peek is Peek for callers holding the lock
+func (s *SyncCache) peek(key string) (interface{}, bool) {
+	v, ok := s.c.Peek(key)
+	if _, reserved := v.(*reservation); reserved {
+		return nil, false
+	}
+	return v, ok
+}
+
+// ForEachSnapshot calls fn for each item in the cache, hottest first, until
+// fn returns false.  It holds the lock only briefly: once to copy the keys,
+// then once per key to look its value up again.  Items removed after the keys
+// were copied are skipped; items added meanwhile are not visited; a value
+// updated meanwhile is seen with its new value.  The walk is therefore only
+// consistent on a best-effort basis, but writers are never blocked for long,
+// and fn may safely use the cache.  Nothing is promoted.
+func (s *SyncCache) ForEachSnapshot(fn func(key string, value interface{}) bool) {
+	s.mu.Lock()
+	keys := make([]string, 0, s.c.count())
+	for seg := len(s.c.lists) - 1; seg >= 0; seg-- {
+		for i := s.c.lists[seg].head; i != 0; i = s.c.items[i].next {
+			keys = append(keys, s.c.items[i].key)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, key := range keys {
+		s.mu.Lock()
+		v, ok := s.peek(key)
+		s.mu.Unlock()
+		if ok && !fn(key, v) {
+			return
+		}
+	}
+}
+
+// TouchMulti promotes each of keys that is present one segment, under a
+// single lock, and returns the number of keys found
+func (s *SyncCache) TouchMulti(keys []string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.TouchMulti(keys)
+}
+
+// Stats returns a snapshot of the cache's counters.  It doesn't take the
+// lock, so it never waits for other users of the cache.
+func (s *SyncCache) Stats() Stats {
+	return s.c.Stats()
+}
+
+// GetTrace performs a Get for each of keys in turn, under a single lock, and
+// returns the segment each key occupies after its Get, or -1 for a miss
+func (s *SyncCache) GetTrace(keys []string) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.GetTrace(keys)
+}
+
+// Set sets a value in the cache
+func (s *SyncCache) Set(key string, value interface{}) {
+	s.mu.Lock()
+	s.c.Set(key, value)
+	s.mu.Unlock()
+}
+
+// SetWithTTL sets a value in the cache that expires after ttl, as for
+// Cache.SetWithTTL
+func (s *SyncCache) SetWithTTL(key string, value interface{}, ttl time.Duration) {
+	s.mu.Lock()
+	s.c.SetWithTTL(key, value, ttl)
+	s.mu.Unlock()
+}
+
+// LoadOrStore returns the existing value for key if present, promoting it as
+// Get does.  Otherwise it stores value and returns it.  loaded is true if the
+// value was already present.  The lookup and store happen under a single lock,
+// so concurrent callers for the same key all observe the same winning value.
+// A key bypassed by WithBypassRate still returns the value stored for it,
+// though the read is counted as a miss.
+func (s *SyncCache) LoadOrStore(key string, value interface{}) (actual interface{}, loaded bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i, found := s.c.get(key); found {
+		if _, reserved := s.c.items[i].value.(*reservation); reserved {
+			// take over the reservation; its commit will see the key is
+			// already filled and leave it alone
+			s.c.items[i].value = value
+			return value, false
+		}
+	}
+
+	if v, ok := s.c.Get(key); ok {
+		return v, true
+	}
+	if v, ok := s.c.Peek(key); ok {
+		// bypassed, but present
+		return v, true
+	}
+
+	s.c.Set(key, value)
+	return value, false
+}
+
+// Len returns the total number of items in the cache, including reserved keys
+func (s *SyncCache) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.Len()
+}
+
+// Remove removes an item from the cache, returning the item and a boolean indicating if it was found
+func (s *SyncCache) Remove(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove(key)
+}
+
+// remove is Remove for callers holding the lock
+func (s *SyncCache) remove(key string) (interface{}, bool) {
+	v, ok := s.c.Remove(key)
+	if _, reserved := v.(*reservation); reserved {
+		return nil, false
+	}
+	return v, ok
+}
+
+// RemoveMulti removes each of keys from the cache, under a single lock, and
+// returns those that were present, in the order given.  Reserved keys are
+// removed but not reported.
+func (s *SyncCache) RemoveMulti(keys []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var removed []string
+	for _, key := range keys {
+		v, ok := s.c.Remove(key)
+		if _, reserved := v.(*reservation); ok && !reserved {
+			removed = append(removed, key)
+		}
+	}
+	return removed
+}
+
+// ReplaceAll replaces the contents of the cache with entries, placed as
+// Cache.Restore places them, under a single lock, so that other goroutines
+// see either the old contents or the new, never some of each, as when
+// mirroring a source that is refreshed wholesale.  The capacity is
+// unchanged: entries that fit nowhere are dropped, so the new contents are
+// only complete if they fit.  Outstanding reservations are dropped too; a
+// later commit stores its value as for an evicted placeholder.
+func (s *SyncCache) ReplaceAll(entries []Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.c.Restore(entries)
+}
+
+// Reserve claims key so that the caller can compute its value without other
+// goroutines doing the same work.  If key is already present or reserved,
+// ok is false and the caller should not compute the value.  Otherwise a
+// placeholder occupies a slot in the cache (and is reported as missing by Get)
+// until exactly one of commit or cancel is called: commit stores the value,
+// cancel removes the placeholder.  If the placeholder was evicted in the
+// meantime, commit inserts the value afresh.
+func (s *SyncCache) Reserve(key string) (commit func(value interface{}), cancel func(), ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.c.get(key); found {
+		return nil, nil, false
+	}
+
+	r := &reservation{}
+	s.c.Set(key, r)
+
+	// held returns the item for key if it still holds this reservation
+	held := func() *cacheItem {
+		if i, found := s.c.get(key); found && s.c.items[i].value == r {
+			return &s.c.items[i]
+		}
+		return nil
+	}
+
+	var once sync.Once
+
+	commit = func(value interface{}) {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if item := held(); item != nil {
+				item.value = value
+				return
+			}
+			if _, found := s.c.get(key); !found {
+				s.c.Set(key, value)
+			}
+		})
+	}
+
+	cancel = func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if held() != nil {
+				s.c.Remove(key)
+			}
+		})
+	}
+
+	return commit, cancel, true
+}
+
+// Tx gives the function passed to Transact access to the cache while it
+// holds the lock.  It is only valid until that function returns.
+type Tx struct {
+	s *SyncCache
+}
+
+// Transact calls fn with the cache locked, so that the Gets, Sets and
+// Removes it makes through tx appear to other goroutines as a single atomic
+// change: for example, a group of related keys can be invalidated without
+// any reader seeing only some of them gone.  Every other use of the cache
+// waits for fn, so fn must not block, and it must not use the SyncCache
+// itself, which would deadlock.
+func (s *SyncCache) Transact(fn func(tx *Tx)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := &Tx{s: s}
+	defer func() { tx.s = nil }()
+	fn(tx)
+}
+
+// Get returns a value from the cache, as for SyncCache.Get
+func (tx *Tx) Get(key string) (interface{}, bool) {
+	return tx.cache().get(key)
+}
+
+// Set sets a value in the cache
+func (tx *Tx) Set(key string, value interface{}) {
+	tx.cache().c.Set(key, value)
+}
+
+// Remove removes an item from the cache, as for SyncCache.Remove
+func (tx *Tx) Remove(key string) (interface{}, bool) {
+	return tx.cache().remove(key)
+}
+
+func (tx *Tx) cache() *SyncCache {
+	if tx.s == nil {
+		panic("s4lru: Tx used after Transact returned")
+	}
+	return tx.s
+}
@@ -0,0 +1,370 @@
+package s4lru
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestReserve(t *testing.T) {
+
+	c := NewSync(4)
+
+	commit, _, ok := c.Reserve("foo")
+	if !ok {
+		t.Fatalf("failed to reserve key in an empty cache")
+	}
+
+	if _, _, ok := c.Reserve("foo"); ok {
+		t.Errorf("reserved an already reserved key")
+	}
+
+	if _, ok := c.Get("foo"); ok {
+		t.Errorf("got a value for an uncommitted reservation")
+	}
+	c.Get("foo")
+
+	// reading a placeholder is a miss and earns it no promotion
+	if st := c.Stats(); st.Hits != 0 || st.Misses != 2 {
+		t.Errorf("Stats()=%+v after two Gets of a reserved key, want 0 hits and 2 misses", st)
+	}
+	if seg := c.c.items[c.c.data["foo"]].lidx; seg != 0 {
+		t.Errorf("reserved key promoted to segment %d", seg)
+	}
+
+	commit("bar")
+
+	if v, ok := c.Get("foo"); !ok || v.(string) != "bar" {
+		t.Errorf("failed to get committed value: got %v, %v", v, ok)
+	}
+
+	if _, _, ok := c.Reserve("foo"); ok {
+		t.Errorf("reserved a key that already has a value")
+	}
+
+	_, cancel, ok := c.Reserve("baz")
+	if !ok {
+		t.Fatalf("failed to reserve key baz")
+	}
+
+	cancel()
+
+	if c.Len() != 1 {
+		t.Errorf("cancelled reservation still occupies the cache: Len()=%d", c.Len())
+	}
+
+	commit, _, ok = c.Reserve("baz")
+	if !ok {
+		t.Fatalf("failed to reserve key baz after cancel")
+	}
+	commit("qux")
+
+	if v, ok := c.Get("baz"); !ok || v.(string) != "qux" {
+		t.Errorf("failed to get value committed after cancel: got %v, %v", v, ok)
+	}
+}
+
+func TestReserveConcurrent(t *testing.T) {
+
+	c := NewSync(4)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := 0
+
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			commit, _, ok := c.Reserve("foo")
+			if !ok {
+				return
+			}
+			mu.Lock()
+			winners++
+			mu.Unlock()
+			commit(i)
+		}(i)
+	}
+	wg.Wait()
+
+	if winners != 1 {
+		t.Errorf("%d goroutines won the reservation, want 1", winners)
+	}
+
+	if _, ok := c.Get("foo"); !ok {
+		t.Errorf("winning value was not stored")
+	}
+}
+
+func TestSyncGetAndModify(t *testing.T) {
+
+	c := NewSync(8)
+	c.Set("n", 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.GetAndModify("n", func(v interface{}) interface{} { return v.(int) + 1 })
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, _ := c.Get("n"); v != 800 {
+		t.Errorf("counter=%v after 800 concurrent increments, want 800", v)
+	}
+}
+
+func TestLoadOrStore(t *testing.T) {
+
+	c := NewSync(64)
+
+	const workers = 32
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, workers)
+	loads := make([]bool, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], loads[i] = c.LoadOrStore("foo", i)
+		}(i)
+	}
+	wg.Wait()
+
+	stored := 0
+	for i := range results {
+		if results[i] != results[0] {
+			t.Errorf("goroutine %d saw %v, goroutine 0 saw %v", i, results[i], results[0])
+		}
+		if !loads[i] {
+			stored++
+		}
+	}
+
+	if stored != 1 {
+		t.Errorf("%d goroutines stored a value, want 1", stored)
+	}
+
+	if v, ok := c.Get("foo"); !ok || v != results[0] {
+		t.Errorf("Get after LoadOrStore: got %v, want %v", v, results[0])
+	}
+
+	// a bypassed key is still loaded, not replaced
+	c = NewSync(4, WithBypassRate(1))
+	if v, loaded := c.LoadOrStore("k", 1); v != 1 || loaded {
+		t.Errorf("first LoadOrStore=(%v,%v), want (1,false)", v, loaded)
+	}
+	if v, loaded := c.LoadOrStore("k", 2); v != 1 || !loaded {
+		t.Errorf("second LoadOrStore=(%v,%v), want (1,true)", v, loaded)
+	}
+}
+
+func TestForEachSnapshot(t *testing.T) {
+
+	c := NewSync(256)
+
+	for i := 0; i < 64; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			key := strconv.Itoa(i % 128)
+			switch i % 3 {
+			case 0:
+				c.Set(key, i)
+			case 1:
+				c.Get(key)
+			case 2:
+				c.Remove(key)
+			}
+		}
+	}()
+
+	for pass := 0; pass < 20; pass++ {
+		seen := make(map[string]bool)
+		c.ForEachSnapshot(func(key string, value interface{}) bool {
+			if seen[key] {
+				t.Errorf("visited %q twice in one walk", key)
+			}
+			seen[key] = true
+			if _, ok := value.(int); !ok {
+				t.Errorf("visited %q with value %v", key, value)
+			}
+			return true
+		})
+	}
+
+	<-done
+
+	// with no concurrent writers the walk sees exactly the cache contents
+	n := 0
+	c.ForEachSnapshot(func(key string, value interface{}) bool {
+		if v, ok := c.Peek(key); !ok || v != value {
+			t.Errorf("visited %q=%v, cache holds %v, %v", key, value, v, ok)
+		}
+		n++
+		return true
+	})
+	if n != c.Len() {
+		t.Errorf("visited %d items, Len()=%d", n, c.Len())
+	}
+
+	// returning false stops the walk
+	n = 0
+	c.ForEachSnapshot(func(string, interface{}) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("walk continued after fn returned false: %d calls", n)
+	}
+}
+
+func TestSyncRemoveMulti(t *testing.T) {
+
+	c := NewSync(16)
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Reserve("r")
+
+	got := c.RemoveMulti([]string{"b", "r", "missing"})
+	if len(got) != 1 || got[0] != "b" {
+		t.Errorf("RemoveMulti()=%v, want [b]", got)
+	}
+	if c.Len() != 1 {
+		t.Errorf("Len()=%d after RemoveMulti, want 1", c.Len())
+	}
+}
+
+func TestReplaceAll(t *testing.T) {
+
+	const size = 8
+	c := NewSync(64) // 16 per segment, so every dataset fits
+
+	// generation gen is size keys named for its parity, each holding gen
+	dataset := func(gen int) []Entry {
+		entries := make([]Entry, size)
+		for k := range entries {
+			entries[k] = Entry{Key: strconv.Itoa(gen%2) + "-" + strconv.Itoa(k), Value: gen}
+		}
+		return entries
+	}
+	c.ReplaceAll(dataset(0))
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// exactly one generation's keys are present, all with
+				// its value
+				c.Transact(func(tx *Tx) {
+					gen := -1
+					n := 0
+					for parity := 0; parity < 2; parity++ {
+						for k := 0; k < size; k++ {
+							v, ok := tx.Get(strconv.Itoa(parity) + "-" + strconv.Itoa(k))
+							if !ok {
+								continue
+							}
+							if n++; gen < 0 {
+								gen = v.(int)
+							}
+							if v != gen || gen%2 != parity {
+								t.Errorf("read %d-%d=%v in generation %d", parity, k, v, gen)
+							}
+						}
+					}
+					if n != size {
+						t.Errorf("read %d keys, want %d", n, size)
+					}
+				})
+			}
+		}()
+	}
+
+	for gen := 1; gen < 500; gen++ {
+		c.ReplaceAll(dataset(gen))
+	}
+	close(done)
+	wg.Wait()
+
+	if c.Len() != size {
+		t.Errorf("Len()=%d after ReplaceAll, want %d", c.Len(), size)
+	}
+}
+
+func TestTransact(t *testing.T) {
+
+	const group = 8
+	c := NewSync(64)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// every key of the group holds the same generation, or
+				// none is present
+				c.Transact(func(tx *Tx) {
+					first, ok := tx.Get("g0")
+					for k := 1; k < group; k++ {
+						v, found := tx.Get("g" + strconv.Itoa(k))
+						if found != ok || v != first {
+							t.Errorf("g%d=(%v,%v) but g0=(%v,%v)", k, v, found, first, ok)
+						}
+					}
+				})
+			}
+		}()
+	}
+
+	for gen := 0; gen < 500; gen++ {
+		c.Transact(func(tx *Tx) {
+			for k := 0; k < group; k++ {
+				key := "g" + strconv.Itoa(k)
+				if gen%3 == 2 {
+					tx.Remove(key)
+				} else {
+					tx.Set(key, gen)
+				}
+			}
+		})
+	}
+	close(done)
+	wg.Wait()
+
+	var leaked *Tx
+	c.Transact(func(tx *Tx) { leaked = tx })
+	defer func() {
+		if recover() == nil {
+			t.Errorf("using a Tx after Transact returned didn't panic")
+		}
+	}()
+	leaked.Get("g0")
+}
@@ -0,0 +1,41 @@
+package s4lru
+
+// The typed getters save callers a type assertion after Get.  Each one is a
+// Get followed by a checked assertion: a value of a different type is
+// reported as ok=false rather than panicking.  The lookup still happens, so a
+// mismatched value is promoted and counted as a hit like any other read.
+
+// GetString returns the string stored under key
+func (c *Cache) GetString(key string) (string, bool) {
+	v, _ := c.Get(key)
+	s, ok := v.(string)
+	return s, ok
+}
+
+// GetInt returns the int stored under key
+func (c *Cache) GetInt(key string) (int, bool) {
+	v, _ := c.Get(key)
+	n, ok := v.(int)
+	return n, ok
+}
+
+// GetInt64 returns the int64 stored under key
+func (c *Cache) GetInt64(key string) (int64, bool) {
+	v, _ := c.Get(key)
+	n, ok := v.(int64)
+	return n, ok
+}
+
+// GetFloat64 returns the float64 stored under key
+func (c *Cache) GetFloat64(key string) (float64, bool) {
+	v, _ := c.Get(key)
+	f, ok := v.(float64)
+	return f, ok
+}
+
+// GetBool returns the bool stored under key
+func (c *Cache) GetBool(key string) (bool, bool) {
+	v, _ := c.Get(key)
+	b, ok := v.(bool)
+	return b, ok
+}
@@ -0,0 +1,60 @@
+package s4lru
+
+import "testing"
+
+func TestTypedGetters(t *testing.T) {
+
+	c := New(40)
+
+	c.Set("s", "str")
+	c.Set("i", 42)
+	c.Set("i64", int64(-7))
+	c.Set("f", 2.5)
+	c.Set("b", true)
+
+	if v, ok := c.GetString("s"); !ok || v != "str" {
+		t.Errorf("GetString(s)=(%q,%v), want (str,true)", v, ok)
+	}
+	if v, ok := c.GetInt("i"); !ok || v != 42 {
+		t.Errorf("GetInt(i)=(%d,%v), want (42,true)", v, ok)
+	}
+	if v, ok := c.GetInt64("i64"); !ok || v != -7 {
+		t.Errorf("GetInt64(i64)=(%d,%v), want (-7,true)", v, ok)
+	}
+	if v, ok := c.GetFloat64("f"); !ok || v != 2.5 {
+		t.Errorf("GetFloat64(f)=(%g,%v), want (2.5,true)", v, ok)
+	}
+	if v, ok := c.GetBool("b"); !ok || !v {
+		t.Errorf("GetBool(b)=(%v,%v), want (true,true)", v, ok)
+	}
+
+	// misses
+	for name, get := range map[string]func(string) bool{
+		"GetString":  func(k string) bool { _, ok := c.GetString(k); return ok },
+		"GetInt":     func(k string) bool { _, ok := c.GetInt(k); return ok },
+		"GetInt64":   func(k string) bool { _, ok := c.GetInt64(k); return ok },
+		"GetFloat64": func(k string) bool { _, ok := c.GetFloat64(k); return ok },
+		"GetBool":    func(k string) bool { _, ok := c.GetBool(k); return ok },
+	} {
+		if get("missing") {
+			t.Errorf("%s(missing) reported ok", name)
+		}
+	}
+
+	// mismatches report ok=false and the zero value
+	if v, ok := c.GetString("i"); ok || v != "" {
+		t.Errorf("GetString(i)=(%q,%v), want (\"\",false)", v, ok)
+	}
+	if v, ok := c.GetInt("i64"); ok || v != 0 {
+		t.Errorf("GetInt(i64)=(%d,%v), want (0,false)", v, ok)
+	}
+	if v, ok := c.GetInt64("i"); ok || v != 0 {
+		t.Errorf("GetInt64(i)=(%d,%v), want (0,false)", v, ok)
+	}
+	if v, ok := c.GetFloat64("i"); ok || v != 0 {
+		t.Errorf("GetFloat64(i)=(%g,%v), want (0,false)", v, ok)
+	}
+	if v, ok := c.GetBool("s"); ok || v {
+		t.Errorf("GetBool(s)=(%v,%v), want (false,false)", v, ok)
+	}
+}